@@ -1,4 +1,5 @@
 #define ENDPOINT        "http://your.endpoint/api/tag"
+#define HEARTBEAT_ENDPOINT "http://your.endpoint/api/device/heartbeat"
 #define ENDPOINT_TOKEN  "your-token"
 
 #define WIFI_SSID       "Your WiFi SSID"
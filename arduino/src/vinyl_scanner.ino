@@ -6,6 +6,14 @@
 #include <HTTPClient.h>
 #include <secrets.h>
 
+#define FIRMWARE_VERSION "1.2.0"
+#define HEARTBEAT_INTERVAL 60 * 1000
+// Must be shorter than the --play-idle-timeout of the server
+#define TAG_HEARTBEAT_INTERVAL 30 * 1000
+
+#define TAG_HEARTBEAT_ENDPOINT ENDPOINT "/heartbeat"
+#define TAG_REMOVED_ENDPOINT   ENDPOINT "/removed"
+
 #define TIMEZONE_OFFSET 1 * 3600
 #define LED_BUILTIN     2
 #define PIN_WS2812B 15  // The ESP32 pin GPIO15 connected to WS2812B
@@ -23,8 +31,12 @@ PN532_HSU pn532hsu(Serial2);
 PN532 nfc(pn532hsu);
 
 uint64_t timestamp_millis;
+unsigned long heartbeatPreviousMillis = 0;
+unsigned long tagHeartbeatPreviousMillis = 0;
+bool nfc_found = false;
 String prev_uid;
 bool vinyl_present = false;
+bool vinyl_unknown = false;
 bool lights_on = false;
 
 void setup() {
@@ -35,14 +47,16 @@ void setup() {
   // Setup PN53x / NFC module
   uint32_t nfcVersion = nfc.getFirmwareVersion();
   if (! nfcVersion) {
-    Serial.print("PN53x not found");
-    while (1); // block forever
+    // Keep running, so that the heartbeat reports the missing chip
+    Serial.println("PN53x not found");
+  } else {
+    nfc_found = true;
+    Serial.print("Found chip PN5"); Serial.println((nfcVersion >> 24) & 0xFF, HEX);
+    Serial.print("Firmware ver. "); Serial.print((nfcVersion >> 16) & 0xFF, DEC);
+    Serial.print('.'); Serial.println((nfcVersion >> 8) & 0xFF, DEC);
+    nfc.SAMConfig();
+    Serial.println("NFC module initialized");
   }
-  Serial.print("Found chip PN5"); Serial.println((nfcVersion >> 24) & 0xFF, HEX);
-  Serial.print("Firmware ver. "); Serial.print((nfcVersion >> 16) & 0xFF, DEC);
-  Serial.print('.'); Serial.println((nfcVersion >> 8) & 0xFF, DEC);
-  nfc.SAMConfig();
-  Serial.println("NFC module initialized");
 
   // Setup Wi-Fi
   WiFi.mode(WIFI_STA);
@@ -59,14 +73,54 @@ void setup() {
   timestamp_millis = millis();
 }
 
-void sendVinylId(String id) {
+// sendVinylId reports the tag to the server, and returns whether the server
+// knows the album of the tag.
+bool sendVinylId(String id) {
   HTTPClient http;
   http.begin(ENDPOINT);
   http.addHeader("Authorization", "Token " + String(ENDPOINT_TOKEN));
 
+  bool known = true;
   int statusCode = http.POST(id);
   if (statusCode != 200) {
     Serial.printf("HTTP GET to %s failed with status code: %d\n", ENDPOINT, statusCode);
+  } else if (http.getString().indexOf("\"status\":\"unknown\"") != -1) {
+    known = false;
+  }
+  http.end();
+  return known;
+}
+
+// sendTagEvent tells the server that the tag is still on the shelf, or that it
+// was removed, depending on the endpoint.
+void sendTagEvent(const char *endpoint, String id) {
+  HTTPClient http;
+  http.begin(endpoint);
+  http.addHeader("Authorization", "Token " + String(ENDPOINT_TOKEN));
+
+  int statusCode = http.POST(id);
+  // The server answers 404 when the tag has no open play, such as unknown tags
+  if (statusCode != 200 && statusCode != 404) {
+    Serial.printf("HTTP POST to %s failed with status code: %d\n", endpoint, statusCode);
+  }
+  http.end();
+}
+
+void sendHeartbeat() {
+  String nfcStatus = nfc_found ? "ok" : "not found";
+
+  char body[160];
+  snprintf(body, sizeof(body), "{\"firmware_version\":\"%s\",\"uptime\":%lu,\"rssi\":%d,\"nfc_status\":\"%s\"}",
+    FIRMWARE_VERSION, millis() / 1000, WiFi.RSSI(), nfcStatus.c_str());
+
+  HTTPClient http;
+  http.begin(HEARTBEAT_ENDPOINT);
+  http.addHeader("Authorization", "Token " + String(ENDPOINT_TOKEN));
+  http.addHeader("Content-Type", "application/json");
+
+  int statusCode = http.POST(body);
+  if (statusCode != 200) {
+    Serial.printf("HTTP POST to %s failed with status code: %d\n", HEARTBEAT_ENDPOINT, statusCode);
   }
   http.end();
 }
@@ -111,6 +165,16 @@ uint32_t Wheel(byte WheelPos) {
 }
 
 void loop() {
+  if (heartbeatPreviousMillis == 0 || millis() - heartbeatPreviousMillis >= HEARTBEAT_INTERVAL) {
+    heartbeatPreviousMillis = millis();
+    sendHeartbeat();
+  }
+
+  if (!nfc_found) {
+    delay(1000);
+    return;
+  }
+
   uint8_t success;
   uint8_t uid[] = { 0, 0, 0, 0, 0, 0, 0 };
   uint8_t uidLength;
@@ -127,22 +191,35 @@ void loop() {
       Serial.printf("\tUID Value: %s\n\n", uidString.c_str());
       Serial.printf("\tPrevious value: %s\n\n", prev_uid.c_str());
 
-      sendVinylId(uidString);
+      vinyl_unknown = !sendVinylId(uidString);
       prev_uid = uidString;
+      tagHeartbeatPreviousMillis = millis();
+    } else if (millis() - tagHeartbeatPreviousMillis >= TAG_HEARTBEAT_INTERVAL) {
+      tagHeartbeatPreviousMillis = millis();
+      sendTagEvent(TAG_HEARTBEAT_ENDPOINT, uidString);
     }
   }
 
+  // If the vinyl is unknown to the server, show it in red instead
+  if (vinyl_present && vinyl_unknown){
+    ws2812b.fill(ws2812b.Color(255, 0, 0));
+    ws2812b.show();
+  }
   // If vinyl is present keep playing rainbow animation
-  if (vinyl_present){
+  else if (vinyl_present){
     if ((unsigned long)(millis() - rainbowPreviousMillis) >= pixelsInterval) {
       rainbowPreviousMillis = millis();
       rainbow();
     }
   }
-  // If there is no tag scanned for 500 ms turn off the led strip and reset vinyl_present variable
+  // If there is no tag scanned for 500 ms turn off the led strip, reset vinyl_present variable
+  // and end the play, so that placing the same vinyl again is a new play
   if (millis() - timestamp_millis > 500 && vinyl_present){
     vinyl_present = false;
     ws2812b.clear();  
     ws2812b.show();  
+
+    sendTagEvent(TAG_REMOVED_ENDPOINT, prev_uid);
+    prev_uid = "";
   }
 }
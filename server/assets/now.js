@@ -0,0 +1,96 @@
+// Keeps the now playing page up to date with the live events of the server.
+(function () {
+  const main = document.querySelector('.now');
+  const plays = main.querySelector('.now-plays');
+  const idle = main.querySelector('.now-idle');
+  const status = main.querySelector('.now-status');
+  let statusTimeout;
+
+  function showStatus(text) {
+    clearTimeout(statusTimeout);
+    status.textContent = text;
+    status.hidden = false;
+    statusTimeout = setTimeout(() => { status.hidden = true; }, 30000);
+  }
+
+  function update() {
+    idle.hidden = plays.children.length !== 0;
+  }
+
+  function element(tag, text) {
+    const el = document.createElement(tag);
+    el.textContent = text;
+    return el;
+  }
+
+  // Each device has at most one album on its shelf, so a new event for a
+  // device replaces whatever was shown for it.
+  function removeDevice(device) {
+    const id = device ? String(device.id) : '';
+    for (const play of plays.querySelectorAll('.now-play')) {
+      if (play.dataset.device === id) {
+        play.remove();
+      }
+    }
+  }
+
+  function showPlay(log) {
+    removeDevice(log.device);
+
+    const play = document.createElement('article');
+    play.className = 'now-play';
+    play.dataset.log = log.id;
+    play.dataset.device = log.device ? log.device.id : '';
+
+    const cover = document.createElement(log.album.cover_url ? 'img' : 'div');
+    cover.className = 'cover';
+    if (log.album.cover_url) {
+      cover.src = log.album.cover_url;
+      cover.alt = '';
+    }
+    play.append(cover);
+
+    const time = new Date(log.time).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit', hour12: false });
+    play.append(
+      element('h1', log.album.name),
+      element('h2', log.album.artist),
+      element('p', (log.device ? log.device.name + ' · ' : '') + 'since ' + time),
+    );
+
+    plays.prepend(play);
+    status.hidden = true;
+    update();
+  }
+
+  const source = new EventSource(main.dataset.events);
+
+  source.addEventListener('scan', (e) => {
+    showPlay(JSON.parse(e.data).log);
+  });
+
+  source.addEventListener('unknown-tag', (e) => {
+    const data = JSON.parse(e.data);
+    removeDevice(data.device);
+    showStatus('Unknown tag scanned' + (data.device ? ' on ' + data.device.name : '') + ': ' + data.tag);
+    update();
+  });
+
+  source.addEventListener('log-deleted', (e) => {
+    const data = JSON.parse(e.data);
+    const play = plays.querySelector(`.now-play[data-log="${data.log_id}"]`);
+    if (play) {
+      play.remove();
+      update();
+    }
+  });
+
+  // Events may have been missed while disconnected, so start over from what
+  // the server has.
+  let connected = false;
+  source.addEventListener('open', () => {
+    if (connected) {
+      location.reload();
+    }
+    connected = true;
+  });
+})();
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// lastfmSessionCommand authorizes the Last.fm API account to scrobble for the
+// user, printing the session key to configure.
+func lastfmSessionCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "lastfm-session",
+		Usage:     "Generate a Last.fm session key to scrobble the plays",
+		ArgsUsage: "[username] [password]",
+		Before:    requireArgs(2),
+		Action: func(ctx *cli.Context) error {
+			apiKey := ctx.String("lastfm-api-key")
+			apiSecret := ctx.String("lastfm-api-secret")
+			if apiKey == "" || apiSecret == "" {
+				return errors.New("the last.fm api key and secret must be set")
+			}
+
+			key, err := lastfmSession(ctx.Context, strings.TrimSuffix(ctx.String("lastfm-url"), "/"), apiKey, apiSecret, ctx.Args().Get(0), ctx.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(key)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// exportCommand writes the albums and the logs to a file, or to the standard
+// output.
+func exportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "Export the albums, the logs or both",
+		ArgsUsage: "[albums|logs|all]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "format of the export: json or csv, which cannot have both the albums and the logs",
+				Value: formatJSON,
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "file to write the export to, instead of the standard output",
+			},
+		},
+		Before: requireArgs(1),
+		Action: func(ctx *cli.Context) error {
+			what, format := ctx.Args().Get(0), ctx.String("format")
+			err := parseExportRequest(what, format)
+			if err != nil {
+				return err
+			}
+
+			return withDatabase(ctx, func(db *database) error {
+				c, err := exportCollection(ctx.Context, db, what)
+				if err != nil {
+					return err
+				}
+
+				var w io.Writer = os.Stdout
+				if output := ctx.String("output"); output != "" {
+					f, err := os.Create(output)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					w = f
+				}
+
+				return writeCollection(w, c, what, format)
+			})
+		},
+	}
+}
+
+// importCommand imports the albums and the logs from a file exported by the
+// export command, or written by hand.
+func importCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Import albums and logs from a json or csv file",
+		ArgsUsage: "[file]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "format of the file: json or csv, guessed from its extension if not set",
+			},
+			&cli.StringFlag{
+				Name:  "on-conflict",
+				Usage: "what to do with albums whose tag belongs to an existing album: skip, overwrite or fail",
+				Value: conflictSkip,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only report what would be imported",
+			},
+		},
+		Before: requireArgs(1),
+		Action: func(ctx *cli.Context) error {
+			name := ctx.Args().Get(0)
+			format, err := importFormat(name, ctx.String("format"))
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			c, err := readCollection(f, format)
+			if err != nil {
+				return err
+			}
+
+			return withDatabase(ctx, func(db *database) error {
+				report, err := importCollection(ctx.Context, db, c, ctx.String("on-conflict"), ctx.Bool("dry-run"))
+				if err != nil {
+					return err
+				}
+
+				fmt.Print(report)
+				return nil
+			})
+		},
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// userCommand manages the users of the dashboard from the command line, for
+// example to create the first admin.
+func userCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "user",
+		Usage: "Manage the users of the dashboard",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "Add a user",
+				ArgsUsage: "[username] [password]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "role",
+						Usage: "role of the user: viewer, editor or admin",
+						Value: roleViewer,
+					},
+				},
+				Before: requireArgs(2),
+				Action: func(ctx *cli.Context) error {
+					role, err := parseRole(ctx.String("role"))
+					if err != nil {
+						return err
+					}
+
+					hash, err := hashPassword(ctx.Args().Get(1))
+					if err != nil {
+						return err
+					}
+
+					return withDatabase(ctx, func(db *database) error {
+						user := &User{Username: ctx.Args().Get(0), PasswordHash: hash, Role: role}
+						err := db.CreateUser(ctx.Context, user)
+						if errors.Is(err, gorm.ErrDuplicatedKey) {
+							return fmt.Errorf("user %s already exists", user.Username)
+						} else if err != nil {
+							return err
+						}
+
+						fmt.Printf("Added %s %s\n", user.Role, user.Username)
+						return nil
+					})
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "Remove a user",
+				ArgsUsage: "[username]",
+				Before:    requireArgs(1),
+				Action: func(ctx *cli.Context) error {
+					return withDatabase(ctx, func(db *database) error {
+						user, err := getUserByUsername(ctx.Context, db, ctx.Args().Get(0))
+						if err != nil {
+							return err
+						}
+
+						err = db.DeleteUser(ctx.Context, user.ID)
+						if err != nil {
+							return err
+						}
+
+						err = db.DeleteUserSessions(ctx.Context, user.ID, 0)
+						if err != nil {
+							return err
+						}
+
+						fmt.Printf("Removed %s\n", user.Username)
+						return nil
+					})
+				},
+			},
+			{
+				Name:      "passwd",
+				Usage:     "Change the password of a user",
+				ArgsUsage: "[username] [password]",
+				Before:    requireArgs(2),
+				Action: func(ctx *cli.Context) error {
+					hash, err := hashPassword(ctx.Args().Get(1))
+					if err != nil {
+						return err
+					}
+
+					return withDatabase(ctx, func(db *database) error {
+						user, err := getUserByUsername(ctx.Context, db, ctx.Args().Get(0))
+						if err != nil {
+							return err
+						}
+
+						user.PasswordHash = hash
+						err = db.UpdateUser(ctx.Context, user)
+						if err != nil {
+							return err
+						}
+
+						err = db.DeleteUserSessions(ctx.Context, user.ID, 0)
+						if err != nil {
+							return err
+						}
+
+						fmt.Printf("Changed the password of %s and logged them out\n", user.Username)
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+func getUserByUsername(ctx context.Context, db *database, username string) (*User, error) {
+	user, err := db.GetUserByUsername(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+	return user, err
+}
+
+func requireArgs(n int) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		if ctx.NArg() != n {
+			return fmt.Errorf("this command must have %d arguments", n)
+		}
+		return nil
+	}
+}
+
+// withDatabase opens the database in the data directory for the duration of
+// the function.
+func withDatabase(ctx *cli.Context, fn func(db *database) error) error {
+	dataDir := ctx.String("data-directory")
+	if dataDir == "" {
+		return errors.New("data directory is not set")
+	}
+
+	err := os.MkdirAll(dataDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	db, err := newDatabase(filepath.Join(dataDir, databaseFile))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return fn(db)
+}
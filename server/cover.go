@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	coverSize      = 1000
+	thumbnailSize  = 300
+	maxCoverUpload = 20 << 20
+
+	// maxCoverDimension bounds the width and height of the images decoded,
+	// since a small file can declare a huge image that would not fit in memory.
+	maxCoverDimension = 8000
+)
+
+// coverFileRegexp matches the names of the files served from the covers
+// directory, so that nothing else can be served from it.
+var coverFileRegexp = regexp.MustCompile(`^[0-9a-f]{32}(-thumb)?\.jpg$`)
+
+var errNoCover = errors.New("cover not found")
+
+// coverPath returns the path of the cover with the given key, or of its
+// thumbnail.
+func (s *server) coverPath(key string, thumbnail bool) string {
+	if thumbnail {
+		return filepath.Join(s.coversDir, key+"-thumb.jpg")
+	}
+	return filepath.Join(s.coversDir, key+".jpg")
+}
+
+// saveCover stores the image, scaled down if needed, along with its thumbnail,
+// and returns the key that identifies them. Keys are random so that covers can
+// be cached forever and their URLs cannot be guessed.
+func (s *server) saveCover(data []byte) (string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid cover image: %w", err)
+	}
+	if cfg.Width > maxCoverDimension || cfg.Height > maxCoverDimension {
+		return "", fmt.Errorf("cover image is %dx%d, larger than %dx%d", cfg.Width, cfg.Height, maxCoverDimension, maxCoverDimension)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid cover image: %w", err)
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+
+	err = writeJPEG(s.coverPath(key, false), resizeImage(img, coverSize), 90)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeJPEG(s.coverPath(key, true), resizeImage(img, thumbnailSize), 85)
+	if err != nil {
+		_ = os.Remove(s.coverPath(key, false))
+		return "", err
+	}
+
+	return key, nil
+}
+
+func (s *server) removeCover(key string) {
+	if key == "" {
+		return
+	}
+	_ = os.Remove(s.coverPath(key, false))
+	_ = os.Remove(s.coverPath(key, true))
+}
+
+// fetchCover downloads the front cover of the release from the Cover Art
+// Archive. It returns errNoCover if the release has none.
+func (s *server) fetchCover(ctx context.Context, mbid string) ([]byte, error) {
+	if s.coverArtURL == "" {
+		return nil, errors.New("cover art archive is disabled")
+	}
+
+	u := fmt.Sprintf("%s/release/%s/front-500", s.coverArtURL, url.PathEscape(mbid))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", metadataUserAgent)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoCover
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxCoverUpload))
+}
+
+// getCover serves the covers and thumbnails. Their names change whenever the
+// cover does, so they can be cached forever.
+func (s *server) getCover(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !coverFileRegexp.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, filepath.Join(s.coversDir, name))
+}
+
+func writeJPEG(path string, img image.Image, quality int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: quality})
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// resizeImage scales the image down, keeping its aspect ratio, so that it fits
+// in a square of the given size. Each pixel is the average of the pixels it
+// covers in the original image.
+func resizeImage(src image.Image, size int) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+
+	dw, dh := size, sh*size/sw
+	if sh > sw {
+		dw, dh = sw*size/sh, size
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := sb.Min.Y+y*sh/dh, sb.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := sb.Min.X+x*sw/dw, sb.Min.X+(x+1)*sw/dw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// encodePNG returns a PNG of the given size that claims, in its header, to
+// have the declared size.
+func encodePNG(t *testing.T, width, height, declaredWidth, declaredHeight int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The IHDR chunk follows the 8 bytes signature: its length, type, width,
+	// height, 5 more bytes of data and the CRC of all but the length.
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:20], uint32(declaredWidth))
+	binary.BigEndian.PutUint32(data[20:24], uint32(declaredHeight))
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestSaveCover(t *testing.T) {
+	s := newTestServer(t, config{})
+
+	key, err := s.saveCover(encodePNG(t, 1200, 600, 1200, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		thumbnail bool
+		size      image.Point
+	}{
+		{false, image.Pt(coverSize, coverSize/2)},
+		{true, image.Pt(thumbnailSize, thumbnailSize/2)},
+	} {
+		f, err := os.Open(s.coverPath(key, tc.thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := image.Pt(cfg.Width, cfg.Height); size != tc.size {
+			t.Errorf("thumbnail %t is %v, want %v", tc.thumbnail, size, tc.size)
+		}
+	}
+}
+
+func TestSaveCoverTooLarge(t *testing.T) {
+	s := newTestServer(t, config{})
+
+	for _, size := range []image.Point{
+		{maxCoverDimension + 1, 1},
+		{1, maxCoverDimension + 1},
+		{20000, 20000},
+	} {
+		_, err := s.saveCover(encodePNG(t, 1, 1, size.X, size.Y))
+		if err == nil {
+			t.Errorf("saveCover() of a %dx%d image succeeded, want an error", size.X, size.Y)
+		}
+	}
+
+	entries, err := os.ReadDir(s.coversDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("covers directory has %d files, want none", len(entries))
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s := newTestServer(t, config{})
+	cookies := login(t, s)
+
+	for _, tc := range []struct {
+		target string
+		field  string
+		size   int
+	}{
+		{"/albums/new", "cover", maxCoverUpload},
+		{"/import", "file", maxImportUpload},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		_ = mw.WriteField(csrfFormField, csrfTokenFor(s, cookies))
+		_ = mw.WriteField("name", "Discovery")
+		_ = mw.WriteField("artist", "Daft Punk")
+		fw, err := mw.CreateFormFile(tc.field, "upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(make([]byte, tc.size))
+		_ = mw.Close()
+
+		r := httptest.NewRequest(http.MethodPost, tc.target, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s status = %d, want %d", tc.target, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
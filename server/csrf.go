@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var errInvalidCSRFToken = errors.New("invalid or missing csrf token, reload the page and try again")
+
+// csrfToken returns the token that the forms of the session must send back.
+// It is derived from the session cookie, so that it changes with every login
+// and cannot be known by other sites.
+func (s *server) csrfToken(r *http.Request) string {
+	session := csrfSessionToken(r)
+	if session == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, s.csrfKey)
+	mac.Write([]byte("csrf:" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mustCSRFToken rejects the requests that modify something without the token
+// of the session, either in the csrf_token form field or in the X-CSRF-Token
+// header. As it is the first to read the body, it also limits its size.
+func (s *server) mustCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit := s.maxUpload(r)
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		expected := s.csrfToken(r)
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			err := r.ParseMultipartForm(limit)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				s.renderError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d MB", limit>>20))
+				return
+			}
+			token = r.PostFormValue(csrfFormField)
+		}
+
+		if expected == "" || !hmac.Equal([]byte(token), []byte(expected)) {
+			s.renderError(w, r, http.StatusForbidden, errInvalidCSRFToken)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxUpload returns the size limit of the body of the request: imported files
+// can be larger than the covers uploaded with the album forms.
+func (s *server) maxUpload(r *http.Request) int64 {
+	if strings.HasPrefix(r.URL.Path, s.basePath+"/import") {
+		return maxImportUpload
+	}
+	return maxCoverUpload
+}
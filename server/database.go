@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
@@ -9,17 +12,27 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// databaseFile is the name of the database in the data directory.
+const databaseFile = "data.sqlite3"
+
 type database struct {
 	db *gorm.DB
 }
 
 func newDatabase(path string) (*database, error) {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		TranslateError: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AutoMigrate(&Album{}, &AlbumTag{}, &Log{}, &SuppressedScan{}, &UnknownScan{}, &ApiToken{}, &Device{}, &User{}, &Session{}, &Scrobble{})
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&Album{}, &Log{})
+	err = migrateAlbumTags(db)
 	if err != nil {
 		return nil, err
 	}
@@ -29,43 +42,275 @@ func newDatabase(path string) (*database, error) {
 	}, nil
 }
 
+// migrateAlbumTags moves the tags of the albums from their own column, from
+// before albums could have several tags, to the album tags.
+func migrateAlbumTags(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Album{}, "tag") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO album_tags (created_at, updated_at, album_id, tag)
+			SELECT created_at, updated_at, id, tag FROM albums WHERE tag <> '' AND deleted_at IS NULL`).Error
+		if err != nil {
+			return err
+		}
+
+		// The tags were unique with either a constraint or, since albums can
+		// be untagged, a partial index.
+		if tx.Migrator().HasConstraint(&Album{}, "uni_albums_tag") {
+			err = tx.Migrator().DropConstraint(&Album{}, "uni_albums_tag")
+			if err != nil {
+				return err
+			}
+		}
+		if tx.Migrator().HasIndex(&Album{}, "idx_albums_tag") {
+			err = tx.Migrator().DropIndex(&Album{}, "idx_albums_tag")
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Migrator().DropColumn(&Album{}, "tag")
+		if err != nil {
+			return err
+		}
+
+		// Dropping a column recreates the table without its indexes.
+		return tx.AutoMigrate(&Album{})
+	})
+}
+
+// Transaction runs the function with a database whose changes are only kept
+// if it returns no error.
+func (d *database) Transaction(ctx context.Context, fn func(tx *database) error) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&database{db: tx})
+	})
+}
+
 func (d *database) Close() error {
 	return nil
 }
 
+// CreateAlbum creates the album, without its tags, which are set with
+// SetAlbumTags.
 func (d *database) CreateAlbum(ctx context.Context, album *Album) error {
-	return d.db.WithContext(ctx).Create(album).Error
+	return d.db.WithContext(ctx).Omit("Tags").Create(album).Error
 }
 
+// UpdateAlbum saves the album, without its tags, which are set with
+// SetAlbumTags.
 func (d *database) UpdateAlbum(ctx context.Context, album *Album) error {
-	return d.db.WithContext(ctx).Save(album).Error
+	return d.db.WithContext(ctx).Omit("Tags").Save(album).Error
+}
+
+// albumSearchColumns are the columns of the albums that are searched. Any
+// new text column describing the album should be added here.
+var albumSearchColumns = []string{
+	"name", "artist", albumTagsColumn, "label", "catalog_number", "barcode", "genres", "tracklist", "mb_id", "CAST(NULLIF(year, 0) AS TEXT)",
 }
 
-func (d *database) CountAlbums(ctx context.Context) (int64, error) {
+// albumTagsColumn selects the tags on each album, separated by commas.
+const albumTagsColumn = "(SELECT group_concat(tag) FROM album_tags WHERE album_tags.album_id = albums.id AND album_tags.removed_at IS NULL AND album_tags.deleted_at IS NULL)"
+
+// AlbumFilter restricts the albums returned by CountAlbums and GetAlbums. Zero
+// values do not restrict anything.
+type AlbumFilter struct {
+	// Search matches the albums that contain every word of it, each in any
+	// of the searched columns, regardless of case.
+	Search string
+}
+
+func (d *database) filterAlbums(ctx context.Context, filter AlbumFilter) *gorm.DB {
+	q := d.db.WithContext(ctx).Model(&Album{})
+	for _, word := range strings.Fields(filter.Search) {
+		pattern := "%" + likeEscaper.Replace(word) + "%"
+
+		var conditions []string
+		var args []interface{}
+		for _, column := range albumSearchColumns {
+			conditions = append(conditions, column+` LIKE ? ESCAPE '\'`)
+			args = append(args, pattern)
+		}
+		q = q.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	return q
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (d *database) CountAlbums(ctx context.Context, filter AlbumFilter) (int64, error) {
 	var count int64
-	return count, d.db.WithContext(ctx).Model(&Album{}).Count(&count).Error
+	return count, d.filterAlbums(ctx, filter).Count(&count).Error
 }
 
-func (d *database) GetAlbums(ctx context.Context, sort, order string, offset, limit int) ([]*Album, error) {
+func (d *database) GetAlbums(ctx context.Context, filter AlbumFilter, sort, order string, offset, limit int) ([]*Album, error) {
 	var albums []*Album
-	return albums, d.db.WithContext(ctx).
+	return albums, d.filterAlbums(ctx, filter).Preload("Tags", preloadTags).
 		Order(clause.OrderByColumn{Column: clause.Column{Name: sort}, Desc: order == "desc"}).
 		Offset(offset).Limit(limit).
 		Find(&albums).Error
 }
 
+// GetArtists returns the distinct artists of the albums, sorted by name.
+func (d *database) GetArtists(ctx context.Context) ([]string, error) {
+	var artists []string
+	return artists, d.db.WithContext(ctx).Model(&Album{}).Distinct("artist").Order("artist").Pluck("artist", &artists).Error
+}
+
 func (d *database) GetAlbum(ctx context.Context, id uint64) (*Album, error) {
 	var album *Album
-	return album, d.db.WithContext(ctx).First(&album, id).Error
+	return album, d.db.WithContext(ctx).Preload("Tags", preloadTags).First(&album, id).Error
 }
 
+// GetAlbumByTag returns the album that the tag is currently on.
 func (d *database) GetAlbumByTag(ctx context.Context, tag string) (*Album, error) {
 	var album *Album
-	return album, d.db.WithContext(ctx).Where("tag = ?", tag).First(&album).Error
+	return album, d.db.WithContext(ctx).Preload("Tags", preloadTags).
+		Where("id = (SELECT album_id FROM album_tags WHERE tag = ? AND removed_at IS NULL AND deleted_at IS NULL)", tag).
+		First(&album).Error
+}
+
+// GetAlbumByName returns the first album with the name and artist.
+func (d *database) GetAlbumByName(ctx context.Context, name, artist string) (*Album, error) {
+	var album *Album
+	return album, d.db.WithContext(ctx).Preload("Tags", preloadTags).
+		Where("name = ? AND artist = ?", name, artist).
+		Order("id ASC").
+		First(&album).Error
+}
+
+// preloadTags only loads the tags currently on the albums.
+func preloadTags(db *gorm.DB) *gorm.DB {
+	return db.Where("removed_at IS NULL").Order("id ASC")
+}
+
+// SetAlbumTags changes the tags on the album to the given ones. Tags on
+// another album are moved to this one if move is set, otherwise nothing is
+// changed and the error wraps gorm.ErrDuplicatedKey. Tags are never deleted,
+// only marked as removed, to keep the tag history of the albums.
+func (d *database) SetAlbumTags(ctx context.Context, album *Album, tags []string, move bool, now time.Time) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if !move {
+			err := checkAlbumTags(tx, album.ID, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		removed := tx.Model(&AlbumTag{}).Where("album_id = ? AND removed_at IS NULL", album.ID)
+		if len(tags) != 0 {
+			removed = removed.Where("tag NOT IN ?", tags)
+		}
+		err := removed.Update("removed_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range tags {
+			if album.HasTag(tag) {
+				continue
+			}
+			err = addAlbumTag(tx, album.ID, tag, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Where("album_id = ?", album.ID).Scopes(preloadTags).Find(&album.Tags).Error
+	})
+}
+
+// CheckAlbumTags returns an error wrapping gorm.ErrDuplicatedKey if one of the
+// tags is on another album than the one with the given ID, which is zero for
+// new albums.
+func (d *database) CheckAlbumTags(ctx context.Context, albumID uint64, tags []string) error {
+	return checkAlbumTags(d.db.WithContext(ctx), albumID, tags)
+}
+
+func checkAlbumTags(tx *gorm.DB, albumID uint64, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var taken AlbumTag
+	err := tx.Where("tag IN ? AND album_id <> ? AND removed_at IS NULL", tags, albumID).Order("id ASC").First(&taken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var other Album
+	err = tx.First(&other, taken.AlbumID).Error
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("the tag %s is already on %s: %w", taken.Tag, other.String(), gorm.ErrDuplicatedKey)
+}
+
+// AddAlbumTag adds the tag to the album, moving it from another album if
+// needed, as the tag was just scanned to be put on this one.
+func (d *database) AddAlbumTag(ctx context.Context, album *Album, tag string, now time.Time) error {
+	if album.HasTag(tag) {
+		return nil
+	}
+
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := addAlbumTag(tx, album.ID, tag, now)
+		if err != nil {
+			return err
+		}
+		return tx.Where("album_id = ?", album.ID).Scopes(preloadTags).Find(&album.Tags).Error
+	})
+}
+
+func addAlbumTag(tx *gorm.DB, albumID uint64, tag string, now time.Time) error {
+	err := tx.Model(&AlbumTag{}).
+		Where("tag = ? AND removed_at IS NULL", tag).
+		Update("removed_at", now).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&AlbumTag{Model: gorm.Model{CreatedAt: now}, AlbumID: albumID, Tag: tag}).Error
+}
+
+// GetAlbumTagHistory returns every tag that was ever on the album, newest
+// first.
+func (d *database) GetAlbumTagHistory(ctx context.Context, albumID uint64) ([]*AlbumTag, error) {
+	var tags []*AlbumTag
+	return tags, d.db.WithContext(ctx).Where("album_id = ?", albumID).Order("created_at DESC, id DESC").Find(&tags).Error
+}
+
+// GetAlbumsToEnrich returns the albums that were not enriched with metadata
+// yet.
+func (d *database) GetAlbumsToEnrich(ctx context.Context) ([]*Album, error) {
+	var albums []*Album
+	return albums, d.db.WithContext(ctx).Where("enriched_at IS NULL").Order("id ASC").Find(&albums).Error
+}
+
+// UpdateAlbumMetadata only saves the metadata of the album, so that it does not
+// undo the changes made to the rest of the album in the meantime.
+func (d *database) UpdateAlbumMetadata(ctx context.Context, album *Album) error {
+	return d.db.WithContext(ctx).Model(album).
+		Select("year", "label", "catalog_number", "barcode", "genres", "tracklist", "mb_id", "enriched_at", "cover").
+		Updates(album).Error
 }
 
+// DeleteAlbum deletes the album and removes its tags, so that they can be
+// stuck on other albums.
 func (d *database) DeleteAlbum(ctx context.Context, id uint64) error {
-	return d.db.WithContext(ctx).Delete(&Album{}, id).Error
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&AlbumTag{}).
+			Where("album_id = ? AND removed_at IS NULL", id).
+			Update("removed_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Album{}, id).Error
+	})
 }
 
 func (d *database) CreateLog(ctx context.Context, album *Album) error {
@@ -75,24 +320,577 @@ func (d *database) CreateLog(ctx context.Context, album *Album) error {
 	}).Error
 }
 
+func (d *database) SaveLog(ctx context.Context, log *Log) error {
+	return d.db.WithContext(ctx).Omit("Album", "Device").Save(log).Error
+}
+
+// HasLog returns whether the album has a log at the given time, to the second.
+func (d *database) HasLog(ctx context.Context, albumID uint64, t time.Time) (bool, error) {
+	from := t.Truncate(time.Second)
+	var count int64
+	err := d.db.WithContext(ctx).Model(&Log{}).
+		Where("album_id = ? AND julianday(time) >= julianday(?) AND julianday(time) < julianday(?)",
+			albumID, from, from.Add(time.Second)).
+		Count(&count).Error
+	return count != 0, err
+}
+
 func (d *database) DeleteLog(ctx context.Context, id uint64) error {
 	return d.db.WithContext(ctx).Delete(&Log{}, id).Error
 }
 
-func (d *database) CountLogs(ctx context.Context) (int64, error) {
+// orderByLogTime orders the logs by time. Log times keep the offset they were
+// given with, so they are compared with julianday rather than as text.
+func orderByLogTime(desc bool) string {
+	if desc {
+		return "julianday(logs.time) DESC"
+	}
+	return "julianday(logs.time) ASC"
+}
+
+// preloadDevice loads the device of the logs, even if it was deleted since.
+func preloadDevice(db *gorm.DB) *gorm.DB {
+	return db.Unscoped()
+}
+
+// LogFilter restricts the logs returned by CountLogs and GetLogs. Zero values
+// do not restrict anything.
+type LogFilter struct {
+	DeviceID uint64
+	AlbumID  uint64
+	// Artist matches the albums of the artist regardless of case.
+	Artist string
+	// From and To are the first and the last day of the logs, in local time.
+	From time.Time
+	To   time.Time
+}
+
+func (d *database) filterLogs(ctx context.Context, filter LogFilter) *gorm.DB {
+	q := d.db.WithContext(ctx).Model(&Log{})
+	if filter.DeviceID != 0 {
+		q = q.Where("logs.device_id = ?", filter.DeviceID)
+	}
+	if filter.AlbumID != 0 {
+		q = q.Where("logs.album_id = ?", filter.AlbumID)
+	}
+	if filter.Artist != "" {
+		q = q.Where("logs.album_id IN (SELECT id FROM albums WHERE artist = ? COLLATE NOCASE)", filter.Artist)
+	}
+	if !filter.From.IsZero() {
+		q = q.Where("julianday(logs.time) >= julianday(?)", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Where("julianday(logs.time) < julianday(?)", filter.To.AddDate(0, 0, 1))
+	}
+	return q
+}
+
+func (d *database) CountLogs(ctx context.Context, filter LogFilter) (int64, error) {
 	var count int64
-	return count, d.db.WithContext(ctx).Model(&Log{}).Count(&count).Error
+	return count, d.filterLogs(ctx, filter).Count(&count).Error
 }
 
-func (d *database) GetLogs(ctx context.Context, order string, offset, limit int) ([]*Log, error) {
+func (d *database) GetLogs(ctx context.Context, filter LogFilter, order string, offset, limit int) ([]*Log, error) {
 	var logs []*Log
-	return logs, d.db.WithContext(ctx).Preload("Album").
-		Order(clause.OrderByColumn{Column: clause.Column{Name: "time"}, Desc: order == "desc"}).
+	return logs, d.filterLogs(ctx, filter).Preload("Album.Tags", preloadTags).Preload("Device", preloadDevice).
+		Order(orderByLogTime(order == "desc")).
 		Offset(offset).Limit(limit).
 		Find(&logs).Error
 }
 
 func (d *database) GetLog(ctx context.Context, id uint64) (*Log, error) {
 	var log *Log
-	return log, d.db.WithContext(ctx).Preload("Album").First(&log, id).Error
+	return log, d.db.WithContext(ctx).Preload("Album.Tags", preloadTags).Preload("Device", preloadDevice).First(&log, id).Error
+}
+
+// StartPlay creates a log for the album that stays open until the album is
+// removed from the device's shelf or it is no longer seen.
+func (d *database) StartPlay(ctx context.Context, album *Album, device *Device, now time.Time) (*Log, error) {
+	log := &Log{
+		Time:     now,
+		LastSeen: &now,
+		AlbumID:  album.ID,
+		Album:    *album,
+	}
+	if device != nil {
+		log.DeviceID = &device.ID
+	}
+	return log, d.db.WithContext(ctx).Omit("Album", "Device").Create(log).Error
+}
+
+func (d *database) GetLatestLog(ctx context.Context) (*Log, error) {
+	var log *Log
+	return log, d.db.WithContext(ctx).Preload("Album.Tags", preloadTags).Preload("Device").
+		Order(orderByLogTime(true)).
+		First(&log).Error
+}
+
+// whereDevice restricts the query to the logs of the device, or to the logs
+// without a device if it is nil.
+func whereDevice(q *gorm.DB, device *Device) *gorm.DB {
+	if device == nil {
+		return q.Where("device_id IS NULL")
+	}
+	return q.Where("device_id = ?", device.ID)
+}
+
+func (d *database) GetLatestPlay(ctx context.Context, device *Device) (*Log, error) {
+	var log *Log
+	return log, whereDevice(d.db.WithContext(ctx), device).Preload("Album.Tags", preloadTags).
+		Order(orderByLogTime(true)).
+		First(&log).Error
+}
+
+// ResumePlay reopens a play, as the album was placed again on the shelf.
+func (d *database) ResumePlay(ctx context.Context, log *Log, now time.Time) error {
+	log.EndTime = nil
+	log.LastSeen = &now
+	return d.db.WithContext(ctx).Model(log).Updates(map[string]interface{}{
+		"end_time":  nil,
+		"last_seen": now,
+	}).Error
+}
+
+func (d *database) GetOpenPlay(ctx context.Context, device *Device) (*Log, error) {
+	var log *Log
+	return log, whereDevice(d.db.WithContext(ctx), device).Preload("Album.Tags", preloadTags).
+		Where("end_time IS NULL AND last_seen IS NOT NULL").
+		Order(orderByLogTime(true)).
+		First(&log).Error
+}
+
+func (d *database) GetOpenPlays(ctx context.Context) ([]*Log, error) {
+	var logs []*Log
+	return logs, d.db.WithContext(ctx).Preload("Album.Tags", preloadTags).Preload("Device").
+		Where("end_time IS NULL AND last_seen IS NOT NULL").
+		Order(orderByLogTime(true)).
+		Find(&logs).Error
+}
+
+func (d *database) TouchPlay(ctx context.Context, log *Log, now time.Time) error {
+	log.LastSeen = &now
+	return d.db.WithContext(ctx).Model(log).Update("last_seen", now).Error
+}
+
+func (d *database) EndPlay(ctx context.Context, log *Log, end time.Time) error {
+	log.EndTime = &end
+	return d.db.WithContext(ctx).Model(log).Update("end_time", end).Error
+}
+
+// EndIdlePlays closes all open plays that have not been seen since the cutoff,
+// using the last time they were seen as the end time.
+func (d *database) EndIdlePlays(ctx context.Context, cutoff time.Time) error {
+	return d.db.WithContext(ctx).Model(&Log{}).
+		Where("end_time IS NULL AND last_seen IS NOT NULL AND last_seen < ?", cutoff).
+		Update("end_time", gorm.Expr("last_seen")).Error
+}
+
+func (d *database) CreateSuppressedScan(ctx context.Context, log *Log, tag string, now time.Time) error {
+	return d.db.WithContext(ctx).Create(&SuppressedScan{
+		Time:  now,
+		Tag:   tag,
+		LogID: log.ID,
+	}).Error
+}
+
+func (d *database) CountSuppressedScans(ctx context.Context) (int64, error) {
+	var count int64
+	return count, d.db.WithContext(ctx).Model(&SuppressedScan{}).Count(&count).Error
+}
+
+func (d *database) GetSuppressedScans(ctx context.Context, offset, limit int) ([]*SuppressedScan, error) {
+	var scans []*SuppressedScan
+	return scans, d.db.WithContext(ctx).Preload("Log.Album").
+		Order("time DESC").
+		Offset(offset).Limit(limit).
+		Find(&scans).Error
+}
+
+// CreateUnknownScan adds the scan of the unknown tag to the inbox. If the tag
+// was already scanned on the device within the window, that scan is counted
+// again instead, and created is false.
+func (d *database) CreateUnknownScan(ctx context.Context, tag string, device *Device, window time.Duration, now time.Time) (scan *UnknownScan, created bool, err error) {
+	err = d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if window > 0 {
+			q := tx.Where("tag = ? AND updated_at >= ?", tag, now.Add(-window))
+			if device != nil {
+				q = q.Where("device_id = ?", device.ID)
+			} else {
+				q = q.Where("device_id IS NULL")
+			}
+			err := q.Order("updated_at DESC").First(&scan).Error
+			if err == nil {
+				scan.Scans++
+				scan.UpdatedAt = now
+				return tx.Model(scan).Updates(map[string]any{"scans": gorm.Expr("scans + 1"), "updated_at": now}).Error
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+
+		scan = &UnknownScan{
+			Model: gorm.Model{CreatedAt: now, UpdatedAt: now},
+			Time:  now,
+			Tag:   tag,
+			Scans: 1,
+		}
+		if device != nil {
+			scan.DeviceID = &device.ID
+		}
+		created = true
+		return tx.Omit("Device").Create(scan).Error
+	})
+	return scan, created, err
+}
+
+func (d *database) CountUnknownScans(ctx context.Context) (int64, error) {
+	var count int64
+	return count, d.db.WithContext(ctx).Model(&UnknownScan{}).Count(&count).Error
+}
+
+func (d *database) GetUnknownScans(ctx context.Context, offset, limit int) ([]*UnknownScan, error) {
+	var scans []*UnknownScan
+	return scans, d.db.WithContext(ctx).Preload("Device", preloadDevice).
+		Order("time DESC").
+		Offset(offset).Limit(limit).
+		Find(&scans).Error
+}
+
+func (d *database) GetUnknownScan(ctx context.Context, id uint64) (*UnknownScan, error) {
+	var scan *UnknownScan
+	return scan, d.db.WithContext(ctx).Preload("Device", preloadDevice).First(&scan, id).Error
+}
+
+// CountUnknownScansOfTag returns the number of scans of the tag waiting in the
+// inbox.
+func (d *database) CountUnknownScansOfTag(ctx context.Context, tag string) (int64, error) {
+	var count int64
+	return count, d.db.WithContext(ctx).Model(&UnknownScan{}).Where("tag = ?", tag).Count(&count).Error
+}
+
+// AssignUnknownScans adds the tag to the album, and logs the plays of every
+// scan of the tag in the inbox at the time of the scan, on the device it was
+// scanned on. The scans are then removed from the inbox. It returns the logs,
+// oldest first.
+func (d *database) AssignUnknownScans(ctx context.Context, tag string, album *Album) ([]*Log, error) {
+	var logs []*Log
+	err := d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if !album.HasTag(tag) {
+			err := addAlbumTag(tx, album.ID, tag, time.Now())
+			if err != nil {
+				return err
+			}
+			err = tx.Where("album_id = ?", album.ID).Scopes(preloadTags).Find(&album.Tags).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		var scans []*UnknownScan
+		err := tx.Preload("Device", preloadDevice).Where("tag = ?", tag).Order("time ASC").Find(&scans).Error
+		if err != nil {
+			return err
+		}
+
+		for _, scan := range scans {
+			log := &Log{
+				Time:     scan.Time,
+				AlbumID:  album.ID,
+				DeviceID: scan.DeviceID,
+			}
+			err = tx.Omit("Album", "Device").Create(log).Error
+			if err != nil {
+				return err
+			}
+			log.Album = *album
+			log.Device = scan.Device
+			logs = append(logs, log)
+		}
+
+		return tx.Where("tag = ?", tag).Delete(&UnknownScan{}).Error
+	})
+	return logs, err
+}
+
+func (d *database) DeleteUnknownScan(ctx context.Context, id uint64) error {
+	return d.db.WithContext(ctx).Delete(&UnknownScan{}, id).Error
+}
+
+func (d *database) CreateScrobbles(ctx context.Context, scrobbles []*Scrobble) error {
+	return d.db.WithContext(ctx).Create(scrobbles).Error
+}
+
+// GetDueScrobbles returns the scrobbles of the service that are due, oldest
+// first.
+func (d *database) GetDueScrobbles(ctx context.Context, service string, now time.Time, limit int) ([]*Scrobble, error) {
+	var scrobbles []*Scrobble
+	return scrobbles, d.db.WithContext(ctx).
+		Where("service = ? AND send_at <= ?", service, now).
+		Order("time ASC").Limit(limit).
+		Find(&scrobbles).Error
+}
+
+// RetryScrobbles saves when the scrobbles are retried, and why they failed.
+func (d *database) RetryScrobbles(ctx context.Context, scrobbles []*Scrobble) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, sb := range scrobbles {
+			err := tx.Model(sb).Select("send_at", "attempts", "error").Updates(sb).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *database) DeleteScrobbles(ctx context.Context, scrobbles []*Scrobble) error {
+	if len(scrobbles) == 0 {
+		return nil
+	}
+	return d.db.WithContext(ctx).Unscoped().Delete(&scrobbles).Error
+}
+
+func (d *database) CreateApiToken(ctx context.Context, token *ApiToken) error {
+	return d.db.WithContext(ctx).Create(token).Error
+}
+
+func (d *database) GetApiTokens(ctx context.Context) ([]*ApiToken, error) {
+	var tokens []*ApiToken
+	return tokens, d.db.WithContext(ctx).Order("name ASC").Find(&tokens).Error
+}
+
+func (d *database) GetApiToken(ctx context.Context, id uint64) (*ApiToken, error) {
+	var token *ApiToken
+	return token, d.db.WithContext(ctx).First(&token, id).Error
+}
+
+func (d *database) TouchApiToken(ctx context.Context, token *ApiToken, now time.Time) error {
+	token.LastUsedAt = &now
+	return d.db.WithContext(ctx).Model(token).UpdateColumn("last_used_at", now).Error
+}
+
+// ReplaceApiToken saves the new value of the token, keeping its ID so that
+// the device it belongs to keeps it.
+func (d *database) ReplaceApiToken(ctx context.Context, token *ApiToken) error {
+	return d.db.WithContext(ctx).Model(token).Select("prefix", "hash", "last_used_at").Updates(token).Error
+}
+
+func (d *database) DeleteApiToken(ctx context.Context, id uint64) error {
+	return d.db.WithContext(ctx).Delete(&ApiToken{}, id).Error
+}
+
+func (d *database) CreateDevice(ctx context.Context, device *Device) error {
+	return d.db.WithContext(ctx).Create(device).Error
+}
+
+func (d *database) UpdateDevice(ctx context.Context, device *Device) error {
+	return d.db.WithContext(ctx).Model(device).Select("name", "location").Updates(device).Error
+}
+
+func (d *database) GetDevices(ctx context.Context) ([]*Device, error) {
+	var devices []*Device
+	return devices, d.db.WithContext(ctx).Preload("ApiToken").Order("name ASC").Find(&devices).Error
+}
+
+func (d *database) GetDevice(ctx context.Context, id uint64) (*Device, error) {
+	var device *Device
+	return device, d.db.WithContext(ctx).Preload("ApiToken").First(&device, id).Error
+}
+
+func (d *database) GetDeviceByApiToken(ctx context.Context, tokenID uint64) (*Device, error) {
+	var device *Device
+	return device, d.db.WithContext(ctx).Where("api_token_id = ?", tokenID).First(&device).Error
+}
+
+func (d *database) TouchDevice(ctx context.Context, device *Device, now time.Time) error {
+	device.LastSeenAt = &now
+	return d.db.WithContext(ctx).Model(device).UpdateColumn("last_seen_at", now).Error
+}
+
+func (d *database) SaveDeviceHeartbeat(ctx context.Context, device *Device) error {
+	return d.db.WithContext(ctx).Model(device).
+		Select("last_seen_at", "heartbeat_at", "firmware_version", "uptime", "rssi", "nfc_status").
+		Updates(device).Error
+}
+
+func (d *database) SetDeviceOffline(ctx context.Context, device *Device, offline bool) error {
+	device.Offline = offline
+	return d.db.WithContext(ctx).Model(device).UpdateColumn("offline", offline).Error
+}
+
+// GetSilentDevices returns the devices not yet notified as offline that were
+// last seen before the cutoff.
+func (d *database) GetSilentDevices(ctx context.Context, cutoff time.Time) ([]*Device, error) {
+	var devices []*Device
+	return devices, d.db.WithContext(ctx).
+		Where("offline = ? AND last_seen_at < ?", false, cutoff).
+		Find(&devices).Error
+}
+
+// DeleteDevice deletes the device and revokes its API token.
+func (d *database) DeleteDevice(ctx context.Context, device *Device) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&ApiToken{}, device.ApiTokenID).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Device{}, device.ID).Error
+	})
+}
+
+func (d *database) CreateUser(ctx context.Context, user *User) error {
+	return d.db.WithContext(ctx).Create(user).Error
+}
+
+func (d *database) GetUsers(ctx context.Context) ([]*User, error) {
+	var users []*User
+	return users, d.db.WithContext(ctx).Order("username ASC").Find(&users).Error
+}
+
+func (d *database) GetUser(ctx context.Context, id uint64) (*User, error) {
+	var user *User
+	return user, d.db.WithContext(ctx).First(&user, id).Error
+}
+
+func (d *database) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	var user *User
+	return user, d.db.WithContext(ctx).Where("username = ?", username).First(&user).Error
+}
+
+func (d *database) UpdateUser(ctx context.Context, user *User) error {
+	return d.db.WithContext(ctx).Model(user).Select("role", "password_hash").Updates(user).Error
+}
+
+// DeleteUser deletes the user for good, so that the username can be taken
+// again.
+func (d *database) DeleteUser(ctx context.Context, id uint64) error {
+	return d.db.WithContext(ctx).Unscoped().Delete(&User{}, id).Error
+}
+
+func (d *database) CreateSession(ctx context.Context, session *Session) error {
+	return d.db.WithContext(ctx).Create(session).Error
+}
+
+// GetSession returns the session with the token hash, if it did not expire.
+func (d *database) GetSession(ctx context.Context, tokenHash string, now time.Time) (*Session, error) {
+	var session *Session
+	return session, d.db.WithContext(ctx).Where("token_hash = ? AND expires_at > ?", tokenHash, now).First(&session).Error
+}
+
+// GetUserSessions returns the sessions of the user that did not expire, the
+// most recently used first.
+func (d *database) GetUserSessions(ctx context.Context, userID uint64, now time.Time) ([]*Session, error) {
+	var sessions []*Session
+	return sessions, d.db.WithContext(ctx).Where("user_id = ? AND expires_at > ?", userID, now).Order("last_seen_at DESC").Find(&sessions).Error
+}
+
+func (d *database) RenewSession(ctx context.Context, session *Session) error {
+	return d.db.WithContext(ctx).Model(session).Select("last_seen_at", "expires_at", "user_agent", "ip").Updates(session).Error
+}
+
+// DeleteSession deletes the session of the user with the given ID. It does
+// nothing if the session belongs to another user.
+func (d *database) DeleteSession(ctx context.Context, userID, id uint64) error {
+	return d.db.WithContext(ctx).Unscoped().Where("user_id = ?", userID).Delete(&Session{}, id).Error
+}
+
+// DeleteUserSessions deletes all the sessions of the user, except the one with
+// the given ID, if any.
+func (d *database) DeleteUserSessions(ctx context.Context, userID, exceptID uint64) error {
+	return d.db.WithContext(ctx).Unscoped().Where("user_id = ? AND id <> ?", userID, exceptID).Delete(&Session{}).Error
+}
+
+func (d *database) DeleteExpiredSessions(ctx context.Context, now time.Time) error {
+	return d.db.WithContext(ctx).Unscoped().Where("expires_at <= ?", now).Delete(&Session{}).Error
+}
+
+type AlbumPlays struct {
+	Album Album `gorm:"embedded"`
+	Plays int64
+}
+
+type ArtistPlays struct {
+	Artist string
+	Plays  int64
+}
+
+type PeriodPlays struct {
+	Period string
+	Plays  int64
+}
+
+type WeekdayHourPlays struct {
+	Weekday int
+	Hour    int
+	Plays   int64
+}
+
+// logsSince returns a query over the non-deleted logs, joined with their
+// non-deleted albums, that happened after since. A zero since means all time.
+func (d *database) logsSince(ctx context.Context, since time.Time) *gorm.DB {
+	q := d.db.WithContext(ctx).Model(&Log{}).
+		Joins("JOIN albums ON albums.id = logs.album_id AND albums.deleted_at IS NULL")
+	if !since.IsZero() {
+		q = q.Where("julianday(logs.time) >= julianday(?)", since)
+	}
+	return q
+}
+
+// GetListeningTime returns the total time that albums were on the shelf, only
+// counting the plays whose end is known.
+func (d *database) GetListeningTime(ctx context.Context, since time.Time) (time.Duration, error) {
+	var seconds float64
+	err := d.logsSince(ctx, since).
+		Select("COALESCE(SUM((julianday(logs.end_time) - julianday(logs.time)) * 86400), 0)").
+		Where("logs.end_time IS NOT NULL").
+		Scan(&seconds).Error
+	return time.Duration(seconds * float64(time.Second)), err
+}
+
+func (d *database) CountPlays(ctx context.Context, since time.Time) (int64, error) {
+	var count int64
+	return count, d.logsSince(ctx, since).Count(&count).Error
+}
+
+func (d *database) GetTopAlbums(ctx context.Context, since time.Time, limit int) ([]*AlbumPlays, error) {
+	var plays []*AlbumPlays
+	return plays, d.logsSince(ctx, since).
+		Select("albums.*, COUNT(logs.id) AS plays").
+		Group("albums.id").
+		Order("plays DESC, albums.name ASC").
+		Limit(limit).
+		Scan(&plays).Error
+}
+
+func (d *database) GetTopArtists(ctx context.Context, since time.Time, limit int) ([]*ArtistPlays, error) {
+	var plays []*ArtistPlays
+	return plays, d.logsSince(ctx, since).
+		Select("albums.artist AS artist, COUNT(logs.id) AS plays").
+		Group("albums.artist").
+		Order("plays DESC, albums.artist ASC").
+		Limit(limit).
+		Scan(&plays).Error
+}
+
+// GetPlaysByDay returns the number of plays per local day, formatted as
+// YYYY-MM-DD, in ascending order. Days without plays are omitted.
+func (d *database) GetPlaysByDay(ctx context.Context, since time.Time) ([]*PeriodPlays, error) {
+	var plays []*PeriodPlays
+	return plays, d.logsSince(ctx, since).
+		Select("date(logs.time, 'localtime') AS period, COUNT(logs.id) AS plays").
+		Group("period").
+		Order("period ASC").
+		Scan(&plays).Error
+}
+
+// GetPlaysByWeekdayHour returns the number of plays per local weekday (0 is
+// Sunday) and hour. Slots without plays are omitted.
+func (d *database) GetPlaysByWeekdayHour(ctx context.Context, since time.Time) ([]*WeekdayHourPlays, error) {
+	var plays []*WeekdayHourPlays
+	return plays, d.logsSince(ctx, since).
+		Select("CAST(strftime('%w', logs.time, 'localtime') AS INTEGER) AS weekday, " +
+			"CAST(strftime('%H', logs.time, 'localtime') AS INTEGER) AS hour, " +
+			"COUNT(logs.id) AS plays").
+		Group("weekday, hour").
+		Scan(&plays).Error
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestSetAlbumTagsOnAnotherAlbum(t *testing.T) {
+	s := newTestServer(t, config{})
+	ctx := context.Background()
+
+	discovery := &Album{Name: "Discovery", Artist: "Daft Punk"}
+	homework := &Album{Name: "Homework", Artist: "Daft Punk"}
+	for _, album := range []*Album{discovery, homework} {
+		err := s.db.CreateAlbum(ctx, album)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.db.SetAlbumTags(ctx, discovery, []string{"A", "B"}, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tags on another album are refused, and nothing changes.
+	err = s.db.SetAlbumTags(ctx, homework, []string{"C", "B"}, false, time.Now())
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("SetAlbumTags() error = %v, want %v", err, gorm.ErrDuplicatedKey)
+	}
+	assertAlbumTags(t, s, discovery.ID, "A", "B")
+	assertAlbumTags(t, s, homework.ID)
+
+	// Unless they are moved.
+	err = s.db.SetAlbumTags(ctx, homework, []string{"C", "B"}, true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAlbumTags(t, s, discovery.ID, "A")
+	assertAlbumTags(t, s, homework.ID, "B", "C")
+
+	history, err := s.db.GetAlbumTagHistory(ctx, discovery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Tag != "B" || history[0].RemovedAt == nil {
+		t.Errorf("tag history of the album = %v, want B removed", history)
+	}
+
+	// Scanning a tag for an album moves it too.
+	err = s.db.AddAlbumTag(ctx, discovery, "C", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAlbumTags(t, s, discovery.ID, "A", "C")
+	assertAlbumTags(t, s, homework.ID, "B")
+}
+
+func assertAlbumTags(t *testing.T, s *server, albumID uint64, want ...string) {
+	t.Helper()
+	album, err := s.db.GetAlbum(context.Background(), albumID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := album.TagList()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("tags of %s = %v, want %v", album.String(), got, want)
+	}
+}
+
+func TestGetLogsFilterUTC(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	local := time.Local
+	time.Local = berlin
+	t.Cleanup(func() { time.Local = local })
+
+	s := newTestServer(t, config{})
+	ctx := context.Background()
+
+	album := &Album{Name: "Discovery", Artist: "Daft Punk"}
+	err = s.db.CreateAlbum(ctx, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logged in UTC late on the 10th, which is already the 11th in Berlin, and
+	// after a log stored in local time that sorts after it as text.
+	utc := &Log{Time: time.Date(2026, 3, 10, 23, 30, 0, 0, time.UTC), AlbumID: album.ID}
+	evening := &Log{Time: time.Date(2026, 3, 10, 23, 45, 0, 0, berlin), AlbumID: album.ID}
+	for _, log := range []*Log{utc, evening} {
+		err = s.db.SaveLog(ctx, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day := time.Date(2026, 3, 11, 0, 0, 0, 0, berlin)
+	logs, err := s.db.GetLogs(ctx, LogFilter{From: day, To: day}, "asc", 0, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].ID != utc.ID {
+		t.Errorf("GetLogs() of %s = %d logs, want the UTC log", day.Format(time.DateOnly), len(logs))
+	}
+
+	logs, err = s.db.GetLogs(ctx, LogFilter{}, "desc", 0, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].ID != utc.ID {
+		t.Errorf("GetLogs() does not return the UTC log first")
+	}
+
+	exists, err := s.db.HasLog(ctx, album.ID, utc.Time.In(berlin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("HasLog() of the UTC log in local time = false, want true")
+	}
+}
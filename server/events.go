@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const eventLogDeleted = "log-deleted"
+
+const (
+	// eventBufferSize is the number of events that can wait to be sent to a
+	// client. Further events are dropped for that client until it catches up.
+	eventBufferSize = 16
+
+	// eventKeepAlive is how often a comment is sent to idle clients, so that
+	// proxies do not close the connection.
+	eventKeepAlive = 30 * time.Second
+)
+
+// liveEvent is something that happened on the shelf, as pushed to the
+// browsers showing the live pages.
+type liveEvent struct {
+	Type string
+	Data *apiEvent
+}
+
+type apiEvent struct {
+	Tag    string     `json:"tag,omitempty"`
+	Log    *apiLog    `json:"log,omitempty"`
+	LogID  uint64     `json:"log_id,omitempty"`
+	Device *apiDevice `json:"device,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// eventBroker fans out the live events to every connected client.
+type eventBroker struct {
+	mu      sync.Mutex
+	clients map[chan *liveEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{clients: map[chan *liveEvent]struct{}{}}
+}
+
+// subscribe returns the channel the events are sent to, and a function that
+// must be called once the client goes away.
+func (b *eventBroker) subscribe() (<-chan *liveEvent, func()) {
+	ch := make(chan *liveEvent, eventBufferSize)
+
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.clients, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends the event to every client without waiting for slow ones.
+func (b *eventBroker) publish(e *liveEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("live event client is too slow, dropping event", "event", e.Type)
+		}
+	}
+}
+
+func (s *server) publishScan(tag string, log *Log) {
+	s.events.publish(&liveEvent{Type: eventScan, Data: &apiEvent{
+		Tag:  tag,
+		Log:  newApiLog(log, s.basePath),
+		Time: time.Now(),
+	}})
+}
+
+func (s *server) publishUnknownTag(tag string, device *Device) {
+	e := &apiEvent{Tag: tag, Time: time.Now()}
+	if device != nil {
+		e.Device = newApiDevice(device)
+	}
+	s.events.publish(&liveEvent{Type: eventUnknownTag, Data: e})
+}
+
+func (s *server) publishLogDeleted(id uint64) {
+	s.events.publish(&liveEvent{Type: eventLogDeleted, Data: &apiEvent{
+		LogID: id,
+		Time:  time.Now(),
+	}})
+}
+
+// getApiEvents streams the live events as server-sent events until the client
+// disconnects.
+func (s *server) getApiEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprint(w, "retry: 5000\n\n")
+	if err == nil {
+		err = rc.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			var data []byte
+			data, err = json.Marshal(e.Data)
+			if err != nil {
+				slog.Error("could not encode live event", "event", e.Type, "error", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
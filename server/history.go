@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Sources of the histories that can be imported.
+const (
+	sourceDiscogs = "discogs"
+	sourceLastfm  = "lastfm"
+)
+
+const (
+	// scrobbleGap is the longest time between two scrobbles of the same album
+	// for them to be part of the same play.
+	scrobbleGap = 30 * time.Minute
+
+	// fuzzyThreshold is how similar, from 0 to 1, the names of an imported
+	// album and an existing one must be to be offered as a match.
+	fuzzyThreshold = 0.8
+
+	// historyLifetime is how long an import waits to be confirmed after its
+	// preview.
+	historyLifetime = time.Hour
+)
+
+// scrobbleTimeLayouts are the layouts of the times in Last.fm CSV dumps,
+// which are in UTC.
+var scrobbleTimeLayouts = []string{"02 Jan 2006 15:04", "02 Jan 2006, 15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", time.RFC3339}
+
+// historyImport is a history read from a Discogs or Last.fm export, matched to
+// the albums of the collection, waiting to be confirmed.
+type historyImport struct {
+	ID        string
+	Source    string
+	Albums    []*historyAlbum
+	ExpiresAt time.Time
+}
+
+// historyAlbum is an album of an imported history, and the existing album it
+// matches, if any. Fuzzy matches are only used once confirmed.
+type historyAlbum struct {
+	Artist        string
+	Name          string
+	Year          int
+	Label         string
+	CatalogNumber string
+	Plays         []*historyPlay
+
+	Match *Album
+	Fuzzy bool
+
+	key string
+}
+
+func (a *historyAlbum) String() string {
+	return (&Album{Name: a.Name, Artist: a.Artist}).String()
+}
+
+// historyPlay is a play of an imported album, at its original time. Plays
+// made of a single scrobble have no end time.
+type historyPlay struct {
+	Time    time.Time
+	EndTime *time.Time
+}
+
+// Matched returns the albums that match an existing one exactly.
+func (h *historyImport) Matched() []*historyAlbum {
+	return h.filter(func(a *historyAlbum) bool { return a.Match != nil && !a.Fuzzy })
+}
+
+// FuzzyMatched returns the albums whose match must be confirmed.
+func (h *historyImport) FuzzyMatched() []*historyAlbum {
+	return h.filter(func(a *historyAlbum) bool { return a.Fuzzy })
+}
+
+// Unmatched returns the albums that are created without a tag.
+func (h *historyImport) Unmatched() []*historyAlbum {
+	return h.filter(func(a *historyAlbum) bool { return a.Match == nil })
+}
+
+// Plays returns the number of plays in the history.
+func (h *historyImport) Plays() int {
+	n := 0
+	for _, a := range h.Albums {
+		n += len(a.Plays)
+	}
+	return n
+}
+
+func (h *historyImport) filter(keep func(a *historyAlbum) bool) []*historyAlbum {
+	var albums []*historyAlbum
+	for _, a := range h.Albums {
+		if keep(a) {
+			albums = append(albums, a)
+		}
+	}
+	return albums
+}
+
+// readHistory reads the albums of a Discogs collection export, or the plays of
+// a Last.fm scrobble dump.
+func readHistory(r io.Reader, source string) ([]*historyAlbum, error) {
+	var albums []*historyAlbum
+	var err error
+	switch source {
+	case sourceDiscogs:
+		albums, err = readDiscogs(r)
+	case sourceLastfm:
+		albums, err = readLastfm(r)
+	default:
+		return nil, fmt.Errorf("unknown source %q, only discogs or lastfm", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(albums) == 0 {
+		return nil, errors.New("no albums found in the file")
+	}
+	return albums, nil
+}
+
+// readDiscogs reads the CSV export of a Discogs collection. Copies of the same
+// release are only read once.
+func readDiscogs(r io.Reader) ([]*historyAlbum, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("csv file is empty")
+	}
+
+	columns := csvColumns(records[0])
+	_, hasArtist := columns["artist"]
+	_, hasTitle := columns["title"]
+	if !hasArtist || !hasTitle {
+		return nil, errors.New("csv file must have the artist and title columns of a discogs export")
+	}
+
+	var albums []*historyAlbum
+	seen := map[string]bool{}
+	var errs []error
+	for i, record := range records[1:] {
+		a := &historyAlbum{
+			Artist:        cleanDiscogsArtist(csvValue(columns, record, "artist")),
+			Name:          csvValue(columns, record, "title"),
+			Label:         csvValue(columns, record, "label"),
+			CatalogNumber: csvValue(columns, record, "catalog#"),
+			Year:          parseYear(csvValue(columns, record, "released")),
+		}
+		if a.Artist == "" || a.Name == "" {
+			errs = append(errs, fmt.Errorf("line %d: artist or title is missing", i+2))
+			continue
+		}
+
+		a.key = albumKey(a.Artist, a.Name)
+		if seen[a.key] {
+			continue
+		}
+		seen[a.key] = true
+		albums = append(albums, a)
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return albums, nil
+}
+
+// cleanDiscogsArtist drops the number of the artist, as well as the asterisk
+// marking a variation of its name.
+func cleanDiscogsArtist(artist string) string {
+	artist = strings.TrimSuffix(strings.TrimSpace(artist), "*")
+	return discogsArtistSuffix.ReplaceAllString(artist, "")
+}
+
+// scrobble is a track listened to, as recorded by Last.fm.
+type scrobble struct {
+	Artist string
+	Album  string
+	Time   time.Time
+}
+
+// readLastfm reads a Last.fm scrobble dump, either as the JSON pages of the
+// recent tracks returned by its API, or as CSV with the artist, album, track
+// and date columns, with or without a header. Scrobbles without an album are
+// skipped.
+func readLastfm(r io.Reader) ([]*historyAlbum, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+
+	var scrobbles []*scrobble
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) != 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		scrobbles, err = readLastfmJSON(trimmed)
+	} else {
+		scrobbles, err = readLastfmCSV(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return groupScrobbles(scrobbles), nil
+}
+
+type lastfmPage struct {
+	RecentTracks struct {
+		Track []lastfmTrack `json:"track"`
+	} `json:"recenttracks"`
+}
+
+type lastfmTrack struct {
+	Artist lastfmText `json:"artist"`
+	Album  lastfmText `json:"album"`
+	Date   *struct {
+		UTS string `json:"uts"`
+	} `json:"date"`
+}
+
+// lastfmText is a name as returned by the Last.fm API, which is in the name
+// field of extended responses.
+type lastfmText struct {
+	Text string `json:"#text"`
+	Name string `json:"name"`
+}
+
+func (t lastfmText) String() string {
+	if t.Text != "" {
+		return strings.TrimSpace(t.Text)
+	}
+	return strings.TrimSpace(t.Name)
+}
+
+func readLastfmJSON(data []byte) ([]*scrobble, error) {
+	var pages []lastfmPage
+	var err error
+	if data[0] == '[' {
+		err = json.Unmarshal(data, &pages)
+	} else {
+		pages = make([]lastfmPage, 1)
+		err = json.Unmarshal(data, &pages[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+
+	var scrobbles []*scrobble
+	for _, page := range pages {
+		for _, track := range page.RecentTracks.Track {
+			// The track playing now has no date.
+			if track.Date == nil {
+				continue
+			}
+			uts, err := strconv.ParseInt(track.Date.UTS, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q: %w", track.Date.UTS, err)
+			}
+			scrobbles = append(scrobbles, &scrobble{
+				Artist: track.Artist.String(),
+				Album:  track.Album.String(),
+				Time:   time.Unix(uts, 0),
+			})
+		}
+	}
+	return scrobbles, nil
+}
+
+func readLastfmCSV(r io.Reader) ([]*scrobble, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("csv file is empty")
+	}
+
+	// Without a header, the columns are the artist, album, track and date.
+	columns := csvColumns(records[0])
+	_, hasArtist := columns["artist"]
+	_, hasAlbum := columns["album"]
+	first := 1
+	if !hasArtist || !hasAlbum {
+		columns = map[string]int{"artist": 0, "album": 1, "date": 3}
+		first = 0
+	}
+
+	var scrobbles []*scrobble
+	var errs []error
+	for i, record := range records[first:] {
+		line := i + first + 1
+
+		t, err := parseScrobbleTime(columns, record)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		scrobbles = append(scrobbles, &scrobble{
+			Artist: csvValue(columns, record, "artist"),
+			Album:  csvValue(columns, record, "album"),
+			Time:   t,
+		})
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return scrobbles, nil
+}
+
+// parseScrobbleTime parses the time of a scrobble, given either as a Unix
+// timestamp or as a date in UTC.
+func parseScrobbleTime(columns map[string]int, record []string) (time.Time, error) {
+	if value := csvValue(columns, record, "uts"); value != "" {
+		uts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid uts: %w", err)
+		}
+		return time.Unix(uts, 0), nil
+	}
+
+	for _, column := range []string{"date", "utc_time", "time"} {
+		value := csvValue(columns, record, column)
+		if value == "" {
+			continue
+		}
+		for _, layout := range scrobbleTimeLayouts {
+			t, err := time.Parse(layout, value)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return time.Time{}, errors.New("date is missing")
+}
+
+// groupScrobbles turns the scrobbles into plays of albums: scrobbles of the
+// same album following each other within the scrobble gap are one play.
+func groupScrobbles(scrobbles []*scrobble) []*historyAlbum {
+	slices.SortStableFunc(scrobbles, func(a, b *scrobble) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	var albums []*historyAlbum
+	byKey := map[string]*historyAlbum{}
+	var last *scrobble
+	var play *historyPlay
+	for _, s := range scrobbles {
+		if s.Artist == "" || s.Album == "" {
+			last = nil
+			continue
+		}
+
+		key := albumKey(s.Artist, s.Album)
+		a, ok := byKey[key]
+		if !ok {
+			a = &historyAlbum{Artist: s.Artist, Name: s.Album, key: key}
+			byKey[key] = a
+			albums = append(albums, a)
+		}
+
+		if last != nil && albumKey(last.Artist, last.Album) == key && s.Time.Sub(last.Time) <= scrobbleGap {
+			end := s.Time
+			play.EndTime = &end
+		} else {
+			play = &historyPlay{Time: s.Time}
+			a.Plays = append(a.Plays, play)
+		}
+		last = s
+	}
+	return albums
+}
+
+// editionSuffix matches the parts in brackets that often tell editions of the
+// same album apart, such as "(Remastered)" or "[Deluxe Edition]".
+var editionSuffix = regexp.MustCompile(`\s*[(\[][^)\]]*[)\]]`)
+
+// matchName normalizes the name of an artist or album to match it across
+// sources, which also differ in a leading "The" and in "&" instead of "and".
+func matchName(name string) string {
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "the ")
+	return normalizeName(strings.ReplaceAll(name, "&", "and"))
+}
+
+func albumKey(artist, name string) string {
+	return matchName(artist) + "\x00" + matchName(name)
+}
+
+// similarity returns how similar two strings are, from 0 to 1, based on their
+// edit distance.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+// matchHistory matches the imported albums to the existing ones, first by
+// their normalized artist and name, and then by the most similar name of the
+// same artist, ignoring editions.
+func matchHistory(albums []*historyAlbum, existing []*Album) {
+	byKey := map[string]*Album{}
+	byArtist := map[string][]*Album{}
+	for _, album := range existing {
+		key := albumKey(album.Artist, album.Name)
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = album
+		}
+		artist := matchName(album.Artist)
+		byArtist[artist] = append(byArtist[artist], album)
+	}
+
+	for _, a := range albums {
+		if album, ok := byKey[a.key]; ok {
+			a.Match = album
+			continue
+		}
+
+		name := matchName(editionSuffix.ReplaceAllString(a.Name, ""))
+		best := 0.0
+		for _, album := range byArtist[matchName(a.Artist)] {
+			score := similarity(name, matchName(editionSuffix.ReplaceAllString(album.Name, "")))
+			if score >= fuzzyThreshold && score > best {
+				best = score
+				a.Match = album
+				a.Fuzzy = true
+			}
+		}
+	}
+}
+
+// importHistory creates the albums that were not matched, without a tag, and
+// the logs of the plays at their original time, all at once or none at all.
+// Fuzzy matches are only used if confirmed, and a new album is created
+// otherwise. Logs at the same time as an existing one are skipped, so that
+// imports can be run again.
+func importHistory(ctx context.Context, db *database, h *historyImport, confirmed func(i int) bool) (*importReport, error) {
+	report := &importReport{}
+	err := db.Transaction(ctx, func(tx *database) error {
+		for i, a := range h.Albums {
+			album, err := importHistoryAlbum(ctx, tx, a, !a.Fuzzy || confirmed(i), report)
+			if err != nil {
+				return err
+			}
+
+			for _, p := range a.Plays {
+				exists, err := tx.HasLog(ctx, album.ID, p.Time)
+				if err != nil {
+					return err
+				}
+				if exists {
+					report.LogsSkipped++
+					continue
+				}
+
+				err = tx.SaveLog(ctx, &Log{Time: p.Time, EndTime: p.EndTime, AlbumID: album.ID})
+				if err != nil {
+					return err
+				}
+				report.LogsCreated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func importHistoryAlbum(ctx context.Context, db *database, a *historyAlbum, useMatch bool, report *importReport) (*Album, error) {
+	if a.Match != nil && useMatch {
+		album, err := db.GetAlbum(ctx, a.Match.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%s was deleted since the preview", a.Match)
+		} else if err != nil {
+			return nil, err
+		}
+		report.AlbumsUnchanged++
+		return album, nil
+	}
+
+	album := &Album{
+		Name:          a.Name,
+		Artist:        a.Artist,
+		Year:          a.Year,
+		Label:         a.Label,
+		CatalogNumber: a.CatalogNumber,
+	}
+	err := db.CreateAlbum(ctx, album)
+	if err != nil {
+		return nil, err
+	}
+	report.AlbumsCreated++
+	report.addChange("Created %s without a tag.", album)
+	return album, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTooManyAttempts = errors.New("too many failed attempts, try again later")
+
+// attemptLimiter slows down the guessing of passwords and tokens. After each
+// failed attempt, the next one has to wait twice as long as the previous one,
+// and after too many of them, attempts are refused for the lockout duration.
+// Attempts are counted by key, such as the client IP or the username, from the
+// moment they begin, so that parallel attempts cannot get past the limit.
+type attemptLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*failedAttempts
+
+	maxFailures int
+	backoff     time.Duration
+	lockout     time.Duration
+}
+
+type failedAttempts struct {
+	count   int
+	pending int
+	last    time.Time
+	until   time.Time
+}
+
+func newAttemptLimiter(maxFailures int, backoff, lockout time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		attempts:    map[string]*failedAttempts{},
+		maxFailures: maxFailures,
+		backoff:     backoff,
+		lockout:     lockout,
+	}
+}
+
+// begin starts an attempt for the keys, unless one of them has to wait, in
+// which case it returns how long, rounded up to the second. Attempts that are
+// still pending count as failed until they are settled with fail, reset or
+// release, so that no more than the maximum number of failures can be
+// attempted at once.
+func (l *attemptLimiter) begin(now time.Time, keys ...string) time.Duration {
+	if l.maxFailures <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		a := l.get(key, now)
+		if a == nil {
+			continue
+		}
+		if a.until.After(now) {
+			wait = max(wait, a.until.Sub(now))
+		} else if a.count+a.pending >= l.maxFailures {
+			wait = max(wait, l.backoff, time.Second)
+		}
+	}
+	if wait > 0 {
+		return (wait + time.Second - 1).Truncate(time.Second)
+	}
+
+	for _, key := range keys {
+		a := l.get(key, now)
+		if a == nil {
+			a = &failedAttempts{}
+			l.attempts[key] = a
+		}
+		a.pending++
+	}
+	return 0
+}
+
+// fail records the failure of an attempt begun for the keys, and returns the
+// ones that were locked out because of it.
+func (l *attemptLimiter) fail(now time.Time, keys ...string) []string {
+	if l.maxFailures <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var locked []string
+	for _, key := range keys {
+		a := l.get(key, now)
+		if a == nil {
+			a = &failedAttempts{}
+			l.attempts[key] = a
+		}
+
+		a.pending = max(a.pending-1, 0)
+		a.count++
+		a.last = now
+		if a.count >= l.maxFailures {
+			a.until = now.Add(l.lockout)
+			if a.count == l.maxFailures {
+				locked = append(locked, key)
+			}
+		} else if l.backoff > 0 {
+			backoff := l.backoff
+			for i := 1; i < a.count && backoff < l.lockout; i++ {
+				backoff *= 2
+			}
+			a.until = now.Add(min(backoff, l.lockout))
+		}
+	}
+	return locked
+}
+
+// reset forgets the failed attempts of the keys, after a successful one.
+func (l *attemptLimiter) reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.attempts, key)
+	}
+}
+
+// release settles an attempt begun for the keys that neither failed nor has to
+// reset the failed ones, such as a valid API token or an internal error.
+func (l *attemptLimiter) release(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if a := l.attempts[key]; a != nil {
+			a.pending = max(a.pending-1, 0)
+		}
+	}
+}
+
+// get returns the failed attempts of the key, unless they are old enough to be
+// forgotten. It must be called with the lock held.
+func (l *attemptLimiter) get(key string, now time.Time) *failedAttempts {
+	a := l.attempts[key]
+	if a != nil && l.expired(a, now) {
+		delete(l.attempts, key)
+		return nil
+	}
+	return a
+}
+
+// expired returns whether the attempts are over, which is once none is pending,
+// there was no failure for the lockout duration and the key is not locked out
+// anymore.
+func (l *attemptLimiter) expired(a *failedAttempts, now time.Time) bool {
+	return a.pending == 0 && !a.until.After(now) && now.Sub(a.last) >= l.lockout
+}
+
+// prune forgets the attempts that are over, so that they do not pile up.
+func (l *attemptLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, a := range l.attempts {
+		if l.expired(a, now) {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// watchAttempts prunes the failed attempts every minute, until the context is
+// cancelled.
+func (s *server) watchAttempts(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.attempts.prune(now)
+		}
+	}
+}
+
+func loginIPKey(ip string) string {
+	return "login-ip:" + ip
+}
+
+func loginUserKey(username string) string {
+	return "login-user:" + strings.ToLower(username)
+}
+
+func apiIPKey(ip string) string {
+	return "api-ip:" + ip
+}
+
+// failAttempt records the failure of an attempt begun for the keys, and
+// reports the lockouts it caused.
+func (s *server) failAttempt(keys ...string) {
+	for _, key := range s.attempts.fail(time.Now(), keys...) {
+		kind, value, _ := strings.Cut(key, ":")
+
+		var what string
+		switch kind {
+		case "login-user":
+			what = "logins of the user " + value
+		case "login-ip":
+			what = "logins from " + value
+		case "api-ip":
+			what = "api requests from " + value
+		}
+
+		slog.Warn("too many failed attempts, locking out", "key", key, "duration", s.attempts.lockout)
+		s.queueNotification(&Notification{
+			Event:   eventLockout,
+			Title:   "Lockout",
+			Message: fmt.Sprintf("Too many failed attempts, %s are refused for %s.", what, s.attempts.lockout),
+		})
+	}
+}
+
+// retryAfter sets the Retry-After header for a request refused for the given
+// duration.
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())))
+}
+
+// parseTrustedProxies parses the IP addresses and CIDR ranges of the trusted
+// proxies.
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return proxies, nil
+}
+
+func (s *server) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the address the request comes from, which is the one of
+// the proxy if there is one.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client. If the request comes from a
+// trusted proxy, the X-Forwarded-For header is followed back to the first
+// address that is not a trusted proxy, as the ones before it could be forged.
+func (s *server) clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !s.isTrustedProxy(addr) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !s.isTrustedProxy(addr) {
+			return addr.Unmap().String()
+		}
+		host = addr.Unmap().String()
+	}
+	return host
+}
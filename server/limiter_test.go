@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiterBegin(t *testing.T) {
+	l := newAttemptLimiter(3, 0, time.Minute)
+	now := time.Now()
+
+	// Attempts count from the moment they begin, so only as many as the
+	// allowed failures can be pending at once.
+	for i := 0; i < 3; i++ {
+		if wait := l.begin(now, "key"); wait != 0 {
+			t.Fatalf("attempt %d: wait = %s, want 0", i+1, wait)
+		}
+	}
+	if wait := l.begin(now, "key"); wait == 0 {
+		t.Fatal("attempt 4 began while 3 were pending")
+	}
+	if wait := l.begin(now, "other"); wait != 0 {
+		t.Fatalf("other key: wait = %s, want 0", wait)
+	}
+
+	// Settling pending attempts without failing frees their place.
+	l.release("key")
+	if wait := l.begin(now, "key"); wait != 0 {
+		t.Fatalf("after release: wait = %s, want 0", wait)
+	}
+
+	for i := 0; i < 2; i++ {
+		if locked := l.fail(now, "key"); len(locked) != 0 {
+			t.Fatalf("failure %d locked out %v", i+1, locked)
+		}
+	}
+	if locked := l.fail(now, "key"); len(locked) != 1 || locked[0] != "key" {
+		t.Fatalf("failure 3 locked out %v, want [key]", locked)
+	}
+	if wait := l.begin(now, "key"); wait != time.Minute {
+		t.Fatalf("after lockout: wait = %s, want %s", wait, time.Minute)
+	}
+
+	l.reset("key")
+	if wait := l.begin(now, "key"); wait != 0 {
+		t.Fatalf("after reset: wait = %s, want 0", wait)
+	}
+}
+
+func TestAttemptLimiterBackoff(t *testing.T) {
+	l := newAttemptLimiter(5, time.Second, time.Minute)
+	now := time.Now()
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if wait := l.begin(now, "key"); wait != 0 {
+			t.Fatalf("attempt %d: wait = %s, want 0", i+1, wait)
+		}
+		l.fail(now, "key")
+		if wait := l.begin(now, "key"); wait != want {
+			t.Fatalf("after failure %d: wait = %s, want %s", i+1, wait, want)
+		}
+		now = now.Add(want)
+	}
+}
+
+func TestLoginParallelAttempts(t *testing.T) {
+	const maxFailures = 3
+	s := newTestServer(t, config{
+		loginMaxAttempts: maxFailures,
+		loginLockout:     time.Minute,
+	})
+
+	var mu sync.Mutex
+	codes := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(s, http.MethodPost, "/login", url.Values{
+				"username": {testUsername},
+				"password": {"wrong"},
+			}, nil)
+			mu.Lock()
+			codes[w.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if codes[http.StatusUnauthorized] > maxFailures {
+		t.Errorf("%d passwords were checked, want at most %d", codes[http.StatusUnauthorized], maxFailures)
+	}
+	if codes[http.StatusUnauthorized]+codes[http.StatusTooManyRequests] != 20 {
+		t.Errorf("status codes = %v, want only %d and %d", codes, http.StatusUnauthorized, http.StatusTooManyRequests)
+	}
+
+	// The right password is refused too while locked out.
+	w := serve(s, http.MethodPost, "/login", url.Values{
+		"username": {testUsername},
+		"password": {testPassword},
+	}, nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("login while locked out: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestLoginResetsAttempts(t *testing.T) {
+	s := newTestServer(t, config{
+		loginMaxAttempts: 3,
+		loginLockout:     time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		w := serve(s, http.MethodPost, "/login", url.Values{
+			"username": {testUsername},
+			"password": {"wrong"},
+		}, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	login(t, s)
+
+	for i := 0; i < 2; i++ {
+		w := serve(s, http.MethodPost, "/login", url.Values{
+			"username": {testUsername},
+			"password": {"wrong"},
+		}, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d after login: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
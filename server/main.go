@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli/v2"
@@ -37,16 +39,81 @@ func main() {
 			EnvVars: []string{"VINYL_PORT"},
 		},
 		&cli.StringFlag{
-			Name:     "telegram-token",
-			Usage:    "telegram bot token",
-			EnvVars:  []string{"VINYL_TG_TOKEN"},
-			Required: true,
+			Name:    "telegram-token",
+			Usage:   "telegram bot token",
+			EnvVars: []string{"VINYL_TG_TOKEN"},
 		},
 		&cli.Int64SliceFlag{
-			Name:     "telegram-chat-id",
-			Usage:    "telegram bot chat id or comma-separated ids",
-			EnvVars:  []string{"VINYL_TG_CHAT_ID"},
-			Required: true,
+			Name:    "telegram-chat-id",
+			Usage:   "telegram bot chat id or comma-separated ids",
+			EnvVars: []string{"VINYL_TG_CHAT_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "telegram-api-url",
+			Value:   "https://api.telegram.org",
+			Usage:   "telegram bot api url",
+			EnvVars: []string{"VINYL_TG_API_URL"},
+		},
+		&cli.BoolFlag{
+			Name:    "telegram-bot",
+			Usage:   "answer telegram messages to create albums for unknown tags and query the history",
+			EnvVars: []string{"VINYL_TG_BOT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "webhook-url",
+			Usage:   "url or comma-separated urls to post json notifications to",
+			EnvVars: []string{"VINYL_WEBHOOK_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "ntfy-url",
+			Usage:   "ntfy topic url to publish notifications to",
+			EnvVars: []string{"VINYL_NTFY_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "ntfy-token",
+			Usage:   "ntfy access token",
+			EnvVars: []string{"VINYL_NTFY_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "gotify-url",
+			Usage:   "gotify server url to send notifications to",
+			EnvVars: []string{"VINYL_GOTIFY_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "gotify-token",
+			Usage:   "gotify application token",
+			EnvVars: []string{"VINYL_GOTIFY_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "smtp-host",
+			Usage:   "smtp server host to send email notifications through",
+			EnvVars: []string{"VINYL_SMTP_HOST"},
+		},
+		&cli.IntFlag{
+			Name:    "smtp-port",
+			Value:   587,
+			Usage:   "smtp server port",
+			EnvVars: []string{"VINYL_SMTP_PORT"},
+		},
+		&cli.StringFlag{
+			Name:    "smtp-username",
+			Usage:   "smtp username",
+			EnvVars: []string{"VINYL_SMTP_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "smtp-password",
+			Usage:   "smtp password",
+			EnvVars: []string{"VINYL_SMTP_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:    "smtp-from",
+			Usage:   "email notifications sender address",
+			EnvVars: []string{"VINYL_SMTP_FROM"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "smtp-to",
+			Usage:   "email notifications recipient or comma-separated recipients",
+			EnvVars: []string{"VINYL_SMTP_TO"},
 		},
 		&cli.StringFlag{
 			Name:     "data-directory",
@@ -56,41 +123,199 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:     "base-url",
-			Usage:    "hostname and path to where the dashboard will be available at",
+			Usage:    "url where the dashboard will be available at, whose path every route is served under",
 			EnvVars:  []string{"VINYL_BASE_URL"},
 			Required: true,
 		},
 		&cli.StringFlag{
 			Name:    "api-token",
-			Usage:   "api endpoint authentication token",
+			Usage:   "api authentication token with every scope, in addition to the ones created in the dashboard",
 			EnvVars: []string{"VINYL_API_TOKEN"},
 		},
+		&cli.BoolFlag{
+			Name:    "now-public",
+			Usage:   "make the now playing page and its live events available without logging in or an api token",
+			EnvVars: []string{"VINYL_NOW_PUBLIC"},
+		},
+		&cli.DurationFlag{
+			Name:    "play-idle-timeout",
+			Usage:   "time without a heartbeat from the shelf after which a play is ended, 0 to disable",
+			EnvVars: []string{"VINYL_PLAY_IDLE_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "play-min-duration",
+			Usage:   "plays removed from the shelf before this duration are discarded",
+			EnvVars: []string{"VINYL_PLAY_MIN_DURATION"},
+		},
+		&cli.DurationFlag{
+			Name:    "dedup-window",
+			Usage:   "scans of the last album on the shelf within this duration of it being seen are not logged again, 0 to disable",
+			EnvVars: []string{"VINYL_DEDUP_WINDOW"},
+		},
+		&cli.StringFlag{
+			Name:    "musicbrainz-url",
+			Usage:   "musicbrainz server url used to look up album metadata, empty to disable",
+			Value:   "https://musicbrainz.org",
+			EnvVars: []string{"VINYL_MUSICBRAINZ_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "discogs-url",
+			Usage:   "discogs api url used to look up album metadata",
+			Value:   "https://api.discogs.com",
+			EnvVars: []string{"VINYL_DISCOGS_URL"},
+		},
 		&cli.StringFlag{
-			Name:    "jwt-secret",
-			Usage:   "jwt tokens secret",
-			EnvVars: []string{"VINYL_JWT_SECRET"},
+			Name:    "discogs-token",
+			Usage:   "discogs personal access token, enables looking up album metadata in discogs",
+			EnvVars: []string{"VINYL_DISCOGS_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "cover-art-url",
+			Usage:   "cover art archive url used to fetch album covers, empty to disable",
+			Value:   "https://coverartarchive.org",
+			EnvVars: []string{"VINYL_COVER_ART_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "listenbrainz-url",
+			Usage:   "listenbrainz api url",
+			Value:   "https://api.listenbrainz.org",
+			EnvVars: []string{"VINYL_LISTENBRAINZ_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "listenbrainz-token",
+			Usage:   "listenbrainz user token, to scrobble the plays",
+			EnvVars: []string{"VINYL_LISTENBRAINZ_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "lastfm-url",
+			Usage:   "last.fm api url",
+			Value:   "https://ws.audioscrobbler.com",
+			EnvVars: []string{"VINYL_LASTFM_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "lastfm-api-key",
+			Usage:   "last.fm api key, to scrobble the plays",
+			EnvVars: []string{"VINYL_LASTFM_API_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "lastfm-api-secret",
+			Usage:   "last.fm api shared secret",
+			EnvVars: []string{"VINYL_LASTFM_API_SECRET"},
+		},
+		&cli.StringFlag{
+			Name:    "lastfm-session-key",
+			Usage:   "last.fm session key of the user, generated with the 'lastfm-session' subcommand",
+			EnvVars: []string{"VINYL_LASTFM_SESSION_KEY"},
+		},
+		&cli.BoolFlag{
+			Name:    "scrobble-tracks",
+			Usage:   "scrobble each track of the album, when its tracklist is known, instead of the album as a single track",
+			EnvVars: []string{"VINYL_SCROBBLE_TRACKS"},
+		},
+		&cli.DurationFlag{
+			Name:    "device-offline-timeout",
+			Usage:   "time without any request from a device after which it is notified as offline, 0 to disable",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"VINYL_DEVICE_OFFLINE_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "secret",
+			Aliases: []string{"jwt-secret"},
+			Usage:   "secret of at least 32 characters to sign the csrf tokens, generated and saved in the data directory if not set",
+			EnvVars: []string{"VINYL_SECRET", "VINYL_JWT_SECRET"},
+		},
+		&cli.DurationFlag{
+			Name:    "session-lifetime",
+			Usage:   "time after which an unused login session expires",
+			Value:   7 * 24 * time.Hour,
+			EnvVars: []string{"VINYL_SESSION_LIFETIME"},
+		},
+		&cli.IntFlag{
+			Name:    "login-max-attempts",
+			Usage:   "failed logins or api requests from an ip address, or failed logins of a username, after which they are locked out, 0 to disable",
+			Value:   5,
+			EnvVars: []string{"VINYL_LOGIN_MAX_ATTEMPTS"},
+		},
+		&cli.DurationFlag{
+			Name:    "login-backoff",
+			Usage:   "time to wait after a failed attempt before the next one, doubled with every failure until the lockout",
+			Value:   time.Second,
+			EnvVars: []string{"VINYL_LOGIN_BACKOFF"},
+		},
+		&cli.DurationFlag{
+			Name:    "login-lockout",
+			Usage:   "time during which attempts are refused once locked out, and after which failed attempts are forgotten",
+			Value:   15 * time.Minute,
+			EnvVars: []string{"VINYL_LOGIN_LOCKOUT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "trusted-proxy",
+			Usage:   "ip address or cidr range, or comma-separated list of them, of the reverse proxies whose X-Forwarded-For header is trusted to find the client ip address",
+			EnvVars: []string{"VINYL_TRUSTED_PROXY"},
 		},
 		&cli.StringFlag{
 			Name:    "login-username",
-			Usage:   "admin interface username",
+			Usage:   "username of an admin account, in addition to the users in the database",
 			EnvVars: []string{"VINYL_LOGIN_USERNAME"},
 		},
 		&cli.StringFlag{
 			Name:    "login-password",
-			Usage:   "admin interface base64 hashed password generated with 'password' subcommand",
+			Usage:   "base64 hashed password of the admin account, generated with the 'password' subcommand",
 			EnvVars: []string{"VINYL_LOGIN_PASSWORD"},
 		},
 	}
 	app.Action = func(ctx *cli.Context) error {
 		cfg := &config{
+			tgAPIURL:  ctx.String("telegram-api-url"),
 			tgToken:   ctx.String("telegram-token"),
 			tgChatIDs: ctx.Int64Slice("telegram-chat-id"),
+			tgBot:     ctx.Bool("telegram-bot"),
+
+			webhookURLs:  ctx.StringSlice("webhook-url"),
+			ntfyURL:      ctx.String("ntfy-url"),
+			ntfyToken:    ctx.String("ntfy-token"),
+			gotifyURL:    ctx.String("gotify-url"),
+			gotifyToken:  ctx.String("gotify-token"),
+			smtpHost:     ctx.String("smtp-host"),
+			smtpPort:     ctx.Int("smtp-port"),
+			smtpUsername: ctx.String("smtp-username"),
+			smtpPassword: ctx.String("smtp-password"),
+			smtpFrom:     ctx.String("smtp-from"),
+			smtpTo:       ctx.StringSlice("smtp-to"),
+
+			musicBrainzURL: ctx.String("musicbrainz-url"),
+			discogsURL:     ctx.String("discogs-url"),
+			discogsToken:   ctx.String("discogs-token"),
+			coverArtURL:    ctx.String("cover-art-url"),
+
+			listenBrainzURL:   ctx.String("listenbrainz-url"),
+			listenBrainzToken: ctx.String("listenbrainz-token"),
+			lastfmURL:         ctx.String("lastfm-url"),
+			lastfmAPIKey:      ctx.String("lastfm-api-key"),
+			lastfmAPISecret:   ctx.String("lastfm-api-secret"),
+			lastfmSessionKey:  ctx.String("lastfm-session-key"),
+			scrobbleTracks:    ctx.Bool("scrobble-tracks"),
+
 			apiToken:  ctx.String("api-token"),
 			dataDir:   ctx.String("data-directory"),
 			baseURL:   ctx.String("base-url"),
-			jwtSecret: ctx.String("jwt-secret"),
+			nowPublic: ctx.Bool("now-public"),
 			username:  ctx.String("login-username"),
 			password:  ctx.String("login-password"),
+
+			secret:          ctx.String("secret"),
+			sessionLifetime: ctx.Duration("session-lifetime"),
+
+			loginMaxAttempts: ctx.Int("login-max-attempts"),
+			loginBackoff:     ctx.Duration("login-backoff"),
+			loginLockout:     ctx.Duration("login-lockout"),
+			trustedProxies:   ctx.StringSlice("trusted-proxy"),
+
+			playIdleTimeout: ctx.Duration("play-idle-timeout"),
+			playMinDuration: ctx.Duration("play-min-duration"),
+			dedupWindow:     ctx.Duration("dedup-window"),
+
+			deviceOfflineTimeout: ctx.Duration("device-offline-timeout"),
 		}
 
 		handler, err := newServer(cfg)
@@ -98,6 +323,10 @@ func main() {
 			return err
 		}
 
+		jobsCtx, cancelJobs := context.WithCancel(context.Background())
+		defer cancelJobs()
+		handler.Start(jobsCtx)
+
 		// Start HTTP handler.
 		quit := make(chan os.Signal, 2)
 		var wg sync.WaitGroup
@@ -158,6 +387,8 @@ func main() {
 		},
 	})
 
+	app.Commands = append(app.Commands, userCommand(), exportCommand(), importCommand(), lastfmSessionCommand())
+
 	err = app.Run(os.Args)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// metadataUserAgent identifies the server to the metadata providers, as
+// MusicBrainz rejects requests without a meaningful user agent.
+const metadataUserAgent = "VinylScanner/1.0 ( https://github.com/ChrisB2351/vinyl-scanner )"
+
+// Release is an album as found by a metadata provider. Search results may
+// lack the details that are only returned by MetadataProvider.Release.
+type Release struct {
+	ID            string
+	Title         string
+	Artist        string
+	Year          int
+	Label         string
+	CatalogNumber string
+	Barcode       string
+	Genres        []string
+	Tracklist     []string
+	MBID          string
+}
+
+// MetadataQuery searches by barcode if there is one, or by artist and title.
+type MetadataQuery struct {
+	Artist  string
+	Title   string
+	Barcode string
+}
+
+// MetadataProvider looks up album metadata in some external database.
+type MetadataProvider interface {
+	Name() string
+	// Search returns the releases that match the query, best match first.
+	Search(ctx context.Context, q MetadataQuery) ([]*Release, error)
+	// Release returns the release with the given provider ID.
+	Release(ctx context.Context, id string) (*Release, error)
+}
+
+func newMetadataProviders(cfg *config) []MetadataProvider {
+	var providers []MetadataProvider
+
+	if cfg.musicBrainzURL != "" {
+		providers = append(providers, &musicBrainzProvider{url: strings.TrimSuffix(cfg.musicBrainzURL, "/")})
+	}
+
+	if cfg.discogsURL != "" && cfg.discogsToken != "" {
+		providers = append(providers, &discogsProvider{url: strings.TrimSuffix(cfg.discogsURL, "/"), token: cfg.discogsToken})
+	}
+
+	return providers
+}
+
+func (s *server) metadataProvider(name string) MetadataProvider {
+	for _, p := range s.metadata {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// applyRelease fills the album metadata from the release. Unless overwrite is
+// set, only the empty fields are filled.
+func applyRelease(album *Album, r *Release, overwrite bool) {
+	set := func(field *string, value string) {
+		if value != "" && (overwrite || *field == "") {
+			*field = value
+		}
+	}
+
+	set(&album.Name, r.Title)
+	set(&album.Artist, r.Artist)
+	set(&album.Label, r.Label)
+	set(&album.CatalogNumber, r.CatalogNumber)
+	set(&album.Barcode, r.Barcode)
+	set(&album.Genres, strings.Join(r.Genres, ", "))
+	set(&album.Tracklist, strings.Join(r.Tracklist, "\n"))
+	set(&album.MBID, r.MBID)
+
+	if r.Year != 0 && (overwrite || album.Year == 0) {
+		album.Year = r.Year
+	}
+}
+
+// findRelease returns the details of the first release that matches the album,
+// going through the providers in order. It returns nil if there is none.
+func (s *server) findRelease(ctx context.Context, album *Album) (*Release, error) {
+	q := MetadataQuery{Artist: album.Artist, Title: album.Name, Barcode: album.Barcode}
+
+	var errs []error
+	for _, p := range s.metadata {
+		releases, err := p.Search(ctx, q)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+
+		for _, r := range releases {
+			// A barcode is specific enough, otherwise make sure that it is
+			// the same album and not, for example, a compilation.
+			if q.Barcode == "" && normalizeName(r.Title) != normalizeName(album.Name) {
+				continue
+			}
+
+			release, err := p.Release(ctx, r.ID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+				break
+			}
+			return release, nil
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// normalizeName lowercases the name and drops everything except letters and
+// digits, so that names can be compared regardless of punctuation.
+func normalizeName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// parseYear returns the year at the start of a date such as 1977-02-04.
+func parseYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, _ := strconv.Atoi(date[:4])
+	return year
+}
+
+// doMetadataRequest executes the request and decodes the JSON response.
+func doMetadataRequest(req *http.Request, result interface{}) error {
+	req.Header.Set("User-Agent", metadataUserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// discogsProvider looks up releases with the Discogs API, where url is the
+// base URL of the API, such as https://api.discogs.com, and token is a
+// personal access token.
+type discogsProvider struct {
+	url   string
+	token string
+}
+
+// discogsArtistSuffix matches the number that Discogs appends to the names of
+// different artists that share the same name, such as "Nirvana (2)".
+var discogsArtistSuffix = regexp.MustCompile(`\s+\(\d+\)$`)
+
+type discogsSearchResult struct {
+	ID      int64    `json:"id"`
+	Title   string   `json:"title"`
+	Year    string   `json:"year"`
+	Label   []string `json:"label"`
+	CatNo   string   `json:"catno"`
+	Genre   []string `json:"genre"`
+	Style   []string `json:"style"`
+	Barcode []string `json:"barcode"`
+}
+
+type discogsRelease struct {
+	ID      int64  `json:"id"`
+	Title   string `json:"title"`
+	Year    int    `json:"year"`
+	Artists []struct {
+		Name string `json:"name"`
+		Join string `json:"join"`
+	} `json:"artists"`
+	Labels []struct {
+		Name  string `json:"name"`
+		CatNo string `json:"catno"`
+	} `json:"labels"`
+	Genres    []string `json:"genres"`
+	Styles    []string `json:"styles"`
+	Tracklist []struct {
+		Title string `json:"title"`
+		Type  string `json:"type_"`
+	} `json:"tracklist"`
+	Identifiers []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifiers"`
+}
+
+func (dc *discogsProvider) Name() string {
+	return "discogs"
+}
+
+func (dc *discogsProvider) Search(ctx context.Context, q MetadataQuery) ([]*Release, error) {
+	params := url.Values{}
+	params.Set("type", "release")
+	params.Set("per_page", "10")
+	if q.Barcode != "" {
+		params.Set("barcode", q.Barcode)
+	} else {
+		params.Set("artist", q.Artist)
+		params.Set("release_title", q.Title)
+	}
+
+	var res struct {
+		Results []*discogsSearchResult `json:"results"`
+	}
+	err := dc.get(ctx, "/database/search?"+params.Encode(), &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []*Release
+	for _, r := range res.Results {
+		// Search results are titled "Artist - Title".
+		artist, title, ok := strings.Cut(r.Title, " - ")
+		if !ok {
+			artist, title = "", r.Title
+		}
+
+		release := &Release{
+			ID:            strconv.FormatInt(r.ID, 10),
+			Title:         title,
+			Artist:        discogsArtistSuffix.ReplaceAllString(artist, ""),
+			Year:          parseYear(r.Year),
+			CatalogNumber: r.CatNo,
+			Genres:        append(r.Genre, r.Style...),
+		}
+		if len(r.Label) > 0 {
+			release.Label = r.Label[0]
+		}
+		if len(r.Barcode) > 0 {
+			release.Barcode = r.Barcode[0]
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+func (dc *discogsProvider) Release(ctx context.Context, id string) (*Release, error) {
+	var r *discogsRelease
+	err := dc.get(ctx, "/releases/"+url.PathEscape(id), &r)
+	if err != nil {
+		return nil, err
+	}
+
+	release := &Release{
+		ID:     strconv.FormatInt(r.ID, 10),
+		Title:  r.Title,
+		Year:   r.Year,
+		Genres: append(r.Genres, r.Styles...),
+	}
+
+	var artist strings.Builder
+	for i, a := range r.Artists {
+		artist.WriteString(discogsArtistSuffix.ReplaceAllString(a.Name, ""))
+		if i < len(r.Artists)-1 {
+			artist.WriteString(" " + a.Join + " ")
+		}
+	}
+	release.Artist = strings.Join(strings.Fields(artist.String()), " ")
+
+	if len(r.Labels) > 0 {
+		release.Label = r.Labels[0].Name
+		release.CatalogNumber = r.Labels[0].CatNo
+	}
+
+	for _, track := range r.Tracklist {
+		// Skip the headings and index tracks that group other tracks.
+		if track.Type == "" || track.Type == "track" {
+			release.Tracklist = append(release.Tracklist, track.Title)
+		}
+	}
+
+	for _, identifier := range r.Identifiers {
+		if identifier.Type == "Barcode" {
+			release.Barcode = strings.ReplaceAll(identifier.Value, " ", "")
+			break
+		}
+	}
+
+	return release, nil
+}
+
+func (dc *discogsProvider) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dc.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Discogs token="+dc.token)
+
+	return doMetadataRequest(req, result)
+}
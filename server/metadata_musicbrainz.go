@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// musicBrainzProvider looks up releases with the MusicBrainz web service,
+// where url is the base URL of the server, such as https://musicbrainz.org.
+type musicBrainzProvider struct {
+	url string
+}
+
+type musicBrainzRelease struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	Date         string `json:"date"`
+	Barcode      string `json:"barcode"`
+	ArtistCredit []struct {
+		Name       string `json:"name"`
+		JoinPhrase string `json:"joinphrase"`
+	} `json:"artist-credit"`
+	LabelInfo []struct {
+		CatalogNumber string `json:"catalog-number"`
+		Label         *struct {
+			Name string `json:"name"`
+		} `json:"label"`
+	} `json:"label-info"`
+	Genres       []musicBrainzGenre `json:"genres"`
+	Tags         []musicBrainzGenre `json:"tags"`
+	ReleaseGroup *struct {
+		Genres []musicBrainzGenre `json:"genres"`
+	} `json:"release-group"`
+	Media []struct {
+		Tracks []struct {
+			Title string `json:"title"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+type musicBrainzGenre struct {
+	Name string `json:"name"`
+}
+
+func (mb *musicBrainzProvider) Name() string {
+	return "musicbrainz"
+}
+
+func (mb *musicBrainzProvider) Search(ctx context.Context, q MetadataQuery) ([]*Release, error) {
+	var query string
+	if q.Barcode != "" {
+		query = "barcode:" + luceneQuote(q.Barcode)
+	} else {
+		query = "artist:" + luceneQuote(q.Artist) + " AND release:" + luceneQuote(q.Title)
+	}
+
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("limit", "10")
+	params.Set("fmt", "json")
+
+	var res struct {
+		Releases []*musicBrainzRelease `json:"releases"`
+	}
+	err := mb.get(ctx, "/ws/2/release?"+params.Encode(), &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []*Release
+	for _, r := range res.Releases {
+		releases = append(releases, r.release())
+	}
+	return releases, nil
+}
+
+func (mb *musicBrainzProvider) Release(ctx context.Context, id string) (*Release, error) {
+	params := url.Values{}
+	params.Set("inc", "artist-credits labels recordings genres release-groups")
+	params.Set("fmt", "json")
+
+	var res *musicBrainzRelease
+	err := mb.get(ctx, "/ws/2/release/"+url.PathEscape(id)+"?"+params.Encode(), &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.release(), nil
+}
+
+func (mb *musicBrainzProvider) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mb.url+path, nil)
+	if err != nil {
+		return err
+	}
+
+	return doMetadataRequest(req, result)
+}
+
+func (r *musicBrainzRelease) release() *Release {
+	release := &Release{
+		ID:      r.ID,
+		Title:   r.Title,
+		Year:    parseYear(r.Date),
+		Barcode: r.Barcode,
+		MBID:    r.ID,
+	}
+
+	var artist strings.Builder
+	for _, credit := range r.ArtistCredit {
+		artist.WriteString(credit.Name + credit.JoinPhrase)
+	}
+	release.Artist = artist.String()
+
+	for _, info := range r.LabelInfo {
+		if info.Label != nil && release.Label == "" {
+			release.Label = info.Label.Name
+		}
+		if info.CatalogNumber != "" && release.CatalogNumber == "" {
+			release.CatalogNumber = info.CatalogNumber
+		}
+	}
+
+	// Genres are often only set on the release group, and search results
+	// only have the tags.
+	genres := r.Genres
+	if len(genres) == 0 && r.ReleaseGroup != nil {
+		genres = r.ReleaseGroup.Genres
+	}
+	if len(genres) == 0 {
+		genres = r.Tags
+	}
+	for _, genre := range genres {
+		release.Genres = append(release.Genres, genre.Name)
+	}
+
+	for _, medium := range r.Media {
+		for _, track := range medium.Tracks {
+			release.Tracklist = append(release.Tracklist, track.Title)
+		}
+	}
+
+	return release
+}
+
+// luceneQuote quotes the value as a phrase in a Lucene query.
+func luceneQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
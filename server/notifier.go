@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	eventScan       = "scan"
+	eventUnknownTag = "unknown-tag"
+	eventError      = "error"
+
+	eventDeviceOffline = "device-offline"
+	eventDeviceOnline  = "device-online"
+
+	eventLockout = "lockout"
+)
+
+// notificationQueueSize is the number of notifications that can wait to be
+// sent. Further notifications are dropped until the queue drains.
+const notificationQueueSize = 100
+
+// Notification is a message about something that happened on the shelf.
+type Notification struct {
+	Event   string
+	Title   string
+	Message string
+	URL     string
+	Tag     string
+	Album   *Album
+	Device  *Device
+
+	// CoverURL and CoverFile are the URL and the path of the thumbnail of
+	// the album cover, if there is one.
+	CoverURL  string
+	CoverFile string
+}
+
+// Text returns the message followed by the link, if any, for the notifiers
+// that only support plain text.
+func (n *Notification) Text() string {
+	if n.URL == "" {
+		return n.Message
+	}
+	return n.Message + "\n\n" + n.URL
+}
+
+// Notifier delivers notifications to some external service.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// newNotifiers creates the notifiers enabled in the configuration, except for
+// Telegram, which is created by the server as it also answers messages.
+func newNotifiers(cfg *config) []Notifier {
+	var notifiers []Notifier
+
+	for _, u := range cfg.webhookURLs {
+		notifiers = append(notifiers, &webhookNotifier{url: u, baseURL: strings.TrimSuffix(cfg.baseURL, "/")})
+	}
+
+	if cfg.ntfyURL != "" {
+		notifiers = append(notifiers, &ntfyNotifier{url: cfg.ntfyURL, token: cfg.ntfyToken})
+	}
+
+	if cfg.gotifyURL != "" {
+		notifiers = append(notifiers, &gotifyNotifier{url: cfg.gotifyURL, token: cfg.gotifyToken})
+	}
+
+	// The sender defaults to the username, when it is an address, as most
+	// servers refuse mails without one.
+	from := cfg.smtpFrom
+	if from == "" && strings.Contains(cfg.smtpUsername, "@") {
+		from = cfg.smtpUsername
+	}
+	if cfg.smtpHost != "" && len(cfg.smtpTo) != 0 && from != "" {
+		notifiers = append(notifiers, &emailNotifier{
+			host:     cfg.smtpHost,
+			port:     cfg.smtpPort,
+			username: cfg.smtpUsername,
+			password: cfg.smtpPassword,
+			from:     from,
+			to:       cfg.smtpTo,
+		})
+	} else if cfg.smtpHost != "" || len(cfg.smtpTo) != 0 {
+		slog.Warn("smtp host, sender or recipient not set, email notifications are disabled")
+	}
+
+	return notifiers
+}
+
+// notify sends the notification through all the configured notifiers. Errors
+// are logged, as there is nowhere else to report them to.
+func (s *server) notify(ctx context.Context, n *Notification) {
+	for _, notifier := range s.notifiers {
+		err := notifier.Notify(ctx, n)
+		if err != nil {
+			slog.Warn("failed to send notification", "notifier", notifier.Name(), "error", err)
+		}
+	}
+}
+
+// queueNotification sends the notification in the background, so that the
+// request that caused it does not wait for the notifiers.
+func (s *server) queueNotification(n *Notification) {
+	select {
+	case s.notifications <- n:
+	default:
+		slog.Warn("notification queue is full, dropping notification", "event", n.Event)
+	}
+}
+
+// sendNotifications sends the queued notifications one at a time, until the
+// context is cancelled.
+func (s *server) sendNotifications(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-s.notifications:
+			notifyCtx, cancel := context.WithTimeout(ctx, time.Second*30)
+			s.notify(notifyCtx, n)
+			cancel()
+		}
+	}
+}
+
+func (s *server) notifyError(tag, message string) {
+	s.queueNotification(&Notification{
+		Event:   eventError,
+		Title:   "Error",
+		Message: message,
+		Tag:     tag,
+	})
+}
+
+// doNotifierRequest executes the request and makes sure the response status
+// code indicates success.
+func doNotifierRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
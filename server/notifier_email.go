@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emailNotifier sends notifications through an SMTP server. STARTTLS is used
+// whenever the server supports it.
+type emailNotifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, n *Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Vinyl Scanner: "+n.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+
+	text := strings.ReplaceAll(n.Text(), "\n", "\r\n")
+	cover, err := readCover(n)
+	if err != nil {
+		return err
+	}
+
+	if cover == nil {
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&msg, "\r\n%s\r\n", text)
+	} else {
+		// Attach the cover to the text.
+		mw := multipart.NewWriter(&msg)
+		fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"text/plain; charset=utf-8"},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(pw, "%s\r\n", text)
+
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Disposition":       {`inline; filename="cover.jpg"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString(cover)
+		for len(encoded) > 76 {
+			fmt.Fprintf(pw, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(pw, "%s\r\n", encoded)
+
+		err = mw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var auth smtp.Auth
+	if e.username != "" {
+		auth = smtp.PlainAuth("", e.username, e.password, e.host)
+	}
+
+	// net/smtp does not support contexts, so the context is only honoured
+	// until the mail is handed over.
+	errCh := make(chan error, 1)
+	go func() {
+		addr := net.JoinHostPort(e.host, strconv.Itoa(e.port))
+		errCh <- smtp.SendMail(addr, auth, e.from, e.to, msg.Bytes())
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		return err
+	}
+}
+
+// readCover returns the cover of the notification, or nil if it has none.
+func readCover(n *Notification) ([]byte, error) {
+	if n.CoverFile == "" {
+		return nil, nil
+	}
+	return os.ReadFile(n.CoverFile)
+}
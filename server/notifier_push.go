@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ntfyNotifier publishes to a ntfy topic, where url is the full topic URL,
+// such as https://ntfy.sh/my-topic.
+type ntfyNotifier struct {
+	url   string
+	token string
+}
+
+func (nt *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (nt *ntfyNotifier) Notify(ctx context.Context, n *Notification) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nt.url, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Title", n.Title)
+	req.Header.Set("Tags", n.Event)
+	if n.URL != "" {
+		req.Header.Set("Click", n.URL)
+	}
+	if n.CoverURL != "" {
+		req.Header.Set("Attach", n.CoverURL)
+	}
+	if nt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+nt.token)
+	}
+
+	return doNotifierRequest(req)
+}
+
+// gotifyNotifier sends messages to a Gotify server, where url is the base URL
+// of the server and token is an application token.
+type gotifyNotifier struct {
+	url   string
+	token string
+}
+
+func (g *gotifyNotifier) Name() string {
+	return "gotify"
+}
+
+func (g *gotifyNotifier) Notify(ctx context.Context, n *Notification) error {
+	payload := map[string]interface{}{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": 5,
+	}
+	notification := map[string]interface{}{}
+	if n.URL != "" {
+		notification["click"] = map[string]string{"url": n.URL}
+	}
+	if n.CoverURL != "" {
+		notification["bigImageUrl"] = n.CoverURL
+	}
+	if len(notification) != 0 {
+		payload["extras"] = map[string]interface{}{
+			"client::notification": notification,
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(g.url, "/") + "/message"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.token)
+
+	return doNotifierRequest(req)
+}
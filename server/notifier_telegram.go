@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPendingTags is the number of unknown tags per chat that can still be
+// registered by replying to the bot.
+const maxPendingTags = 20
+
+// telegramBot sends notifications to the configured chats and, if enabled,
+// answers the messages sent to it. See telegram_bot.go.
+type telegramBot struct {
+	s           *server
+	apiURL      string
+	token       string
+	chatIDs     []int64
+	interactive bool
+
+	pendingMu sync.Mutex
+	pending   map[int64][]pendingTag
+}
+
+type pendingTag struct {
+	MessageID int
+	Tag       string
+	Device    *Device
+}
+
+func newTelegramBot(s *server, apiURL, token string, chatIDs []int64, interactive bool) *telegramBot {
+	return &telegramBot{
+		s:           s,
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		token:       token,
+		chatIDs:     chatIDs,
+		interactive: interactive,
+		pending:     map[int64][]pendingTag{},
+	}
+}
+
+func (t *telegramBot) Name() string {
+	return "telegram"
+}
+
+func (t *telegramBot) Notify(ctx context.Context, n *Notification) error {
+	text := n.Text()
+	if t.interactive && n.Event == eventUnknownTag {
+		text += "\n\nOr reply to this message with \"Artist - Album\" to create it and log the play."
+	}
+
+	var errs []error
+	for _, chatID := range t.chatIDs {
+		var msg *telegramMessage
+		var err error
+		if n.CoverFile != "" {
+			msg, err = t.sendPhoto(ctx, chatID, n.CoverFile, text)
+		}
+		if n.CoverFile == "" || err != nil {
+			msg, err = t.sendMessage(ctx, chatID, text)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chat %d: %w", chatID, err))
+			continue
+		}
+
+		if n.Event == eventUnknownTag {
+			t.addPendingTag(chatID, pendingTag{MessageID: msg.MessageID, Tag: n.Tag, Device: n.Device})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *telegramBot) addPendingTag(chatID int64, p pendingTag) {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+
+	pending := append(t.pending[chatID], p)
+	if len(pending) > maxPendingTags {
+		pending = pending[len(pending)-maxPendingTags:]
+	}
+	t.pending[chatID] = pending
+}
+
+// takePendingTag removes and returns the unknown tag notified in the given
+// message or, if messageID is zero, the latest notified unknown tag.
+func (t *telegramBot) takePendingTag(chatID int64, messageID int) (pendingTag, bool) {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+
+	pending := t.pending[chatID]
+	for i := len(pending) - 1; i >= 0; i-- {
+		if messageID == 0 || pending[i].MessageID == messageID {
+			p := pending[i]
+			t.pending[chatID] = append(pending[:i:i], pending[i+1:]...)
+			return p, true
+		}
+	}
+
+	return pendingTag{}, false
+}
+
+// putBackPendingTag returns a tag taken with takePendingTag, among the tags
+// notified since at the place of its message.
+func (t *telegramBot) putBackPendingTag(chatID int64, p pendingTag) {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+
+	pending := t.pending[chatID]
+	i := slices.IndexFunc(pending, func(other pendingTag) bool { return other.MessageID > p.MessageID })
+	if i == -1 {
+		i = len(pending)
+	}
+	pending = slices.Insert(pending, i, p)
+	if len(pending) > maxPendingTags {
+		pending = pending[len(pending)-maxPendingTags:]
+	}
+	t.pending[chatID] = pending
+}
+
+type telegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type telegramMessage struct {
+	MessageID      int              `json:"message_id"`
+	Chat           telegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+}
+
+type telegramUpdate struct {
+	UpdateID int              `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+func (t *telegramBot) sendMessage(ctx context.Context, chatID int64, text string) (*telegramMessage, error) {
+	var msg *telegramMessage
+	return msg, t.call(ctx, "sendMessage", map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	}, &msg)
+}
+
+// sendPhoto uploads the photo with the text as its caption.
+func (t *telegramBot) sendPhoto(ctx context.Context, chatID int64, path, caption string) (*telegramMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	_ = mw.WriteField("caption", caption)
+	fw, err := mw.CreateFormFile("photo", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(fw, f)
+	if err != nil {
+		return nil, err
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg *telegramMessage
+	return msg, t.do(ctx, "sendPhoto", mw.FormDataContentType(), &body, &msg)
+}
+
+// call invokes a Telegram Bot API method and decodes its result.
+func (t *telegramBot) call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return t.do(ctx, method, "application/json", bytes.NewReader(body), result)
+}
+
+func (t *telegramBot) do(ctx context.Context, method, contentType string, body io.Reader, result interface{}) error {
+	u := fmt.Sprintf("%s/bot%s/%s", t.apiURL, t.token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Do not leak the token, which is part of the URL, into the logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s: %w", method, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var apiResp struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	err = json.Unmarshal(data, &apiResp)
+	if err != nil {
+		return fmt.Errorf("%s: unexpected response with status code %d", method, resp.StatusCode)
+	}
+
+	if !apiResp.OK {
+		return fmt.Errorf("%s: %s", method, apiResp.Description)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(apiResp.Result, result)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestNewNotifiersEmail(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		from     string
+		username string
+		want     string
+	}{
+		{"sender", "vinyl@example.com", "user@example.com", "vinyl@example.com"},
+		{"username", "", "user@example.com", "user@example.com"},
+		{"username not an address", "", "apikey", ""},
+		{"no sender", "", "", ""},
+	} {
+		notifiers := newNotifiers(&config{
+			smtpHost:     "smtp.example.com",
+			smtpUsername: tc.username,
+			smtpFrom:     tc.from,
+			smtpTo:       []string{"me@example.com"},
+		})
+
+		var from string
+		for _, n := range notifiers {
+			if email, ok := n.(*emailNotifier); ok {
+				from = email.from
+			}
+		}
+		if from != tc.want {
+			t.Errorf("%s: email sender = %q, want %q", tc.name, from, tc.want)
+		}
+	}
+}
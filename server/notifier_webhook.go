@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type webhookNotifier struct {
+	url string
+
+	// baseURL is where the covers of the albums are linked from.
+	baseURL string
+}
+
+type webhookPayload struct {
+	Event   string     `json:"event"`
+	Title   string     `json:"title"`
+	Message string     `json:"message"`
+	URL     string     `json:"url,omitempty"`
+	Tag     string     `json:"tag,omitempty"`
+	Album   *apiAlbum  `json:"album,omitempty"`
+	Device  *apiDevice `json:"device,omitempty"`
+	Cover   string     `json:"cover_url,omitempty"`
+}
+
+func (wh *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (wh *webhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	payload := webhookPayload{
+		Event:   n.Event,
+		Title:   n.Title,
+		Message: n.Message,
+		URL:     n.URL,
+		Tag:     n.Tag,
+		Cover:   n.CoverURL,
+	}
+	if n.Album != nil {
+		payload.Album = newApiAlbum(n.Album, wh.baseURL)
+	}
+	if n.Device != nil {
+		payload.Device = newApiDevice(n.Device)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doNotifierRequest(req)
+}
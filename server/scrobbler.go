@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// scrobbleInterval is how often the queue of scrobbles is checked.
+	scrobbleInterval = 30 * time.Second
+
+	// scrobbleBatchSize is the most scrobbles submitted at once, which is the
+	// limit of Last.fm.
+	scrobbleBatchSize = 50
+
+	// scrobbleTrackLength is the length assumed for the tracks of an album, as
+	// it is not known, to space out their scrobbles.
+	scrobbleTrackLength = 4 * time.Minute
+
+	// scrobbleBackoff is the wait before retrying a failed scrobble, doubled
+	// on each failure up to scrobbleMaxBackoff.
+	scrobbleBackoff    = time.Minute
+	scrobbleMaxBackoff = time.Hour
+)
+
+// errScrobbleRejected is returned by the scrobblers when the service refuses
+// the scrobbles for good, so that they are not retried.
+var errScrobbleRejected = errors.New("scrobble rejected")
+
+// Scrobbler submits the plays to a service keeping the listening history.
+type Scrobbler interface {
+	Name() string
+	Scrobble(ctx context.Context, scrobbles []*Scrobble) error
+}
+
+// newScrobblers creates the scrobblers enabled in the configuration.
+func newScrobblers(cfg *config) []Scrobbler {
+	var scrobblers []Scrobbler
+
+	if cfg.listenBrainzToken != "" {
+		scrobblers = append(scrobblers, &listenBrainzScrobbler{
+			url:   strings.TrimSuffix(cfg.listenBrainzURL, "/"),
+			token: cfg.listenBrainzToken,
+		})
+	}
+
+	if cfg.lastfmAPIKey != "" && cfg.lastfmAPISecret != "" && cfg.lastfmSessionKey != "" {
+		scrobblers = append(scrobblers, &lastfmScrobbler{
+			url:        strings.TrimSuffix(cfg.lastfmURL, "/"),
+			apiKey:     cfg.lastfmAPIKey,
+			apiSecret:  cfg.lastfmAPISecret,
+			sessionKey: cfg.lastfmSessionKey,
+		})
+	}
+
+	return scrobblers
+}
+
+// queueScrobbles adds the play to the queue of every scrobbler, either as the
+// album or, if enabled and known, as each track of it. Tracks are spaced out
+// as if they were all of the same length, and are only submitted once they
+// would have been played for half of it, and the play is long enough to be
+// kept.
+func (s *server) queueScrobbles(ctx context.Context, log *Log, album *Album) error {
+	if len(s.scrobblers) == 0 {
+		return nil
+	}
+
+	tracks := []string{album.Name}
+	if s.scrobbleTracks && len(album.TrackList()) != 0 {
+		tracks = album.TrackList()
+	}
+
+	minSendAt := log.Time.Add(s.playMinDuration)
+	var scrobbles []*Scrobble
+	for i, track := range tracks {
+		t := log.Time.Add(time.Duration(i) * scrobbleTrackLength)
+		sendAt := t.Add(scrobbleTrackLength / 2)
+		if sendAt.Before(minSendAt) {
+			sendAt = minSendAt
+		}
+
+		for _, sc := range s.scrobblers {
+			sb := &Scrobble{
+				Service: sc.Name(),
+				LogID:   log.ID,
+				Time:    t,
+				Artist:  album.Artist,
+				Album:   album.Name,
+				Track:   track,
+				MBID:    album.MBID,
+				SendAt:  sendAt,
+			}
+			if len(tracks) > 1 {
+				sb.TrackNumber = i + 1
+			}
+			scrobbles = append(scrobbles, sb)
+		}
+	}
+
+	return s.db.CreateScrobbles(ctx, scrobbles)
+}
+
+// watchScrobbles periodically submits the scrobbles that are due, until the
+// context is cancelled. Scrobbles are kept in the database until they are
+// submitted, so that they survive outages of the services and restarts.
+func (s *server) watchScrobbles(ctx context.Context) {
+	if len(s.scrobblers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(scrobbleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, sc := range s.scrobblers {
+				err := s.sendScrobbles(ctx, sc, now)
+				if err != nil {
+					slog.Error("could not send scrobbles", "scrobbler", sc.Name(), "error", err)
+				}
+			}
+		}
+	}
+}
+
+// sendScrobbles submits the due scrobbles of the scrobbler. Scrobbles of plays
+// that were discarded, or of tracks after the end of the play, are dropped.
+func (s *server) sendScrobbles(ctx context.Context, sc Scrobbler, now time.Time) error {
+	due, err := s.db.GetDueScrobbles(ctx, sc.Name(), now, scrobbleBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var dropped, scrobbles []*Scrobble
+	for _, sb := range due {
+		log, err := s.db.GetLog(ctx, sb.LogID)
+		if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && log.EndTime != nil && !sb.Time.Before(*log.EndTime)) {
+			dropped = append(dropped, sb)
+			continue
+		} else if err != nil {
+			return err
+		}
+		scrobbles = append(scrobbles, sb)
+	}
+
+	err = s.db.DeleteScrobbles(ctx, dropped)
+	if err != nil {
+		return err
+	}
+	if len(scrobbles) == 0 {
+		return nil
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = sc.Scrobble(sendCtx, scrobbles)
+	cancel()
+	if errors.Is(err, errScrobbleRejected) {
+		slog.Warn("scrobbles rejected", "scrobbler", sc.Name(), "count", len(scrobbles), "error", err)
+		return s.db.DeleteScrobbles(ctx, scrobbles)
+	} else if err != nil {
+		slog.Warn("could not submit scrobbles, retrying later", "scrobbler", sc.Name(), "count", len(scrobbles), "error", err)
+		for _, sb := range scrobbles {
+			sb.Attempts++
+			sb.Error = err.Error()
+			sb.SendAt = now.Add(scrobbleRetryWait(sb.Attempts))
+		}
+		return s.db.RetryScrobbles(ctx, scrobbles)
+	}
+
+	slog.Info("submitted scrobbles", "scrobbler", sc.Name(), "count", len(scrobbles))
+	return s.db.DeleteScrobbles(ctx, scrobbles)
+}
+
+// scrobbleRetryWait returns how long to wait before retrying a scrobble that
+// failed the given number of times.
+func scrobbleRetryWait(attempts int) time.Duration {
+	wait := scrobbleBackoff
+	for i := 1; i < attempts && wait < scrobbleMaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, scrobbleMaxBackoff)
+}
+
+// scrobbleError describes a failed request to a scrobbling service, wrapping
+// errScrobbleRejected if it should not be retried.
+func scrobbleError(rejected bool, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	if rejected {
+		return fmt.Errorf("%w: %w", errScrobbleRejected, err)
+	}
+	return err
+}
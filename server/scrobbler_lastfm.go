@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lastfmInvalidParameters is the error code of Last.fm for requests that
+// would be refused again if retried.
+const lastfmInvalidParameters = 6
+
+// lastfmScrobbler submits scrobbles to Last.fm, where url is the base URL of
+// the API, such as https://ws.audioscrobbler.com, apiKey and apiSecret belong
+// to an API account, and sessionKey authorizes it for the user, as obtained
+// with the lastfm-session command.
+type lastfmScrobbler struct {
+	url        string
+	apiKey     string
+	apiSecret  string
+	sessionKey string
+}
+
+func (lf *lastfmScrobbler) Name() string {
+	return "lastfm"
+}
+
+func (lf *lastfmScrobbler) Scrobble(ctx context.Context, scrobbles []*Scrobble) error {
+	params := url.Values{}
+	params.Set("method", "track.scrobble")
+	params.Set("sk", lf.sessionKey)
+	for i, sb := range scrobbles {
+		key := func(name string) string {
+			return name + "[" + strconv.Itoa(i) + "]"
+		}
+		params.Set(key("artist"), sb.Artist)
+		params.Set(key("track"), sb.Track)
+		params.Set(key("album"), sb.Album)
+		params.Set(key("timestamp"), strconv.FormatInt(sb.Time.Unix(), 10))
+		if sb.TrackNumber != 0 {
+			params.Set(key("trackNumber"), strconv.Itoa(sb.TrackNumber))
+		}
+	}
+
+	return lastfmCall(ctx, lf.url, lf.apiKey, lf.apiSecret, params, nil)
+}
+
+// lastfmSession returns a session key authorizing the API account to scrobble
+// for the user.
+func lastfmSession(ctx context.Context, apiURL, apiKey, apiSecret, username, password string) (string, error) {
+	params := url.Values{}
+	params.Set("method", "auth.getMobileSession")
+	params.Set("username", username)
+	params.Set("password", password)
+
+	var res struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}
+	err := lastfmCall(ctx, apiURL, apiKey, apiSecret, params, &res)
+	if err != nil {
+		return "", err
+	}
+	if res.Session.Key == "" {
+		return "", errors.New("no session key returned")
+	}
+	return res.Session.Key, nil
+}
+
+// lastfmCall signs and posts the call to the Last.fm API, and decodes its
+// response into result, if not nil.
+func lastfmCall(ctx context.Context, apiURL, apiKey, apiSecret string, params url.Values, result any) error {
+	params.Set("api_key", apiKey)
+	params.Set("api_sig", lastfmSignature(params, apiSecret))
+	params.Set("format", "json")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/2.0/", strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", metadataUserAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	var res struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &res)
+	if res.Error != 0 {
+		return scrobbleError(res.Error == lastfmInvalidParameters, "error %d: %s", res.Error, res.Message)
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+// lastfmSignature signs the parameters of a call, as required by Last.fm: the
+// MD5 of the sorted names and values, followed by the secret.
+func lastfmSignature(params url.Values, secret string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "format" && name != "callback" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(params.Get(name))
+	}
+	b.WriteString(secret)
+
+	hash := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// listenBrainzScrobbler submits listens to ListenBrainz, where url is the base
+// URL of the API, such as https://api.listenbrainz.org, and token is the user
+// token found in the settings.
+type listenBrainzScrobbler struct {
+	url   string
+	token string
+}
+
+type listenBrainzListen struct {
+	ListenedAt int64 `json:"listened_at"`
+	Track      struct {
+		ArtistName  string         `json:"artist_name"`
+		TrackName   string         `json:"track_name"`
+		ReleaseName string         `json:"release_name"`
+		Info        map[string]any `json:"additional_info"`
+	} `json:"track_metadata"`
+}
+
+func (lb *listenBrainzScrobbler) Name() string {
+	return "listenbrainz"
+}
+
+func (lb *listenBrainzScrobbler) Scrobble(ctx context.Context, scrobbles []*Scrobble) error {
+	listens := make([]*listenBrainzListen, len(scrobbles))
+	for i, sb := range scrobbles {
+		l := &listenBrainzListen{ListenedAt: sb.Time.Unix()}
+		l.Track.ArtistName = sb.Artist
+		l.Track.TrackName = sb.Track
+		l.Track.ReleaseName = sb.Album
+		l.Track.Info = map[string]any{
+			"media_player":      "Vinyl Scanner",
+			"submission_client": "vinyl-server",
+		}
+		if sb.TrackNumber != 0 {
+			l.Track.Info["tracknumber"] = sb.TrackNumber
+		}
+		if sb.MBID != "" {
+			l.Track.Info["release_mbid"] = sb.MBID
+		}
+		listens[i] = l
+	}
+
+	listenType := "import"
+	if len(listens) == 1 {
+		listenType = "single"
+	}
+	body, err := json.Marshal(map[string]any{
+		"listen_type": listenType,
+		"payload":     listens,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lb.url+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+lb.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	// Invalid listens are refused with a bad request, and would be refused
+	// again, unlike an invalid token that can still be fixed.
+	var res struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	rejected := resp.StatusCode == http.StatusBadRequest
+	if res.Error == "" {
+		return scrobbleError(rejected, "unexpected status code %d", resp.StatusCode)
+	}
+	return scrobbleError(rejected, "unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(res.Error))
+}
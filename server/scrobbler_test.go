@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeListenBrainz is a ListenBrainz API that answers with the given status
+// code and records the listens submitted.
+type fakeListenBrainz struct {
+	mu      sync.Mutex
+	status  int
+	listens []*listenBrainzListen
+}
+
+func newFakeListenBrainz(t *testing.T, token string) (*fakeListenBrainz, *httptest.Server) {
+	f := &fakeListenBrainz{status: http.StatusOK}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/1/submit-listens" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token "+token {
+			http.Error(w, `{"error":"Invalid authorization token."}`, http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			ListenType string                `json:"listen_type"`
+			Payload    []*listenBrainzListen `json:"payload"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid JSON."}`, http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.status != http.StatusOK {
+			http.Error(w, `{"error":"Something went wrong."}`, f.status)
+			return
+		}
+		f.listens = append(f.listens, req.Payload...)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func (f *fakeListenBrainz) setStatus(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeListenBrainz) submitted() []*listenBrainzListen {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.listens)
+}
+
+func (f *fakeListenBrainz) tracks() []string {
+	var tracks []string
+	for _, l := range f.submitted() {
+		tracks = append(tracks, l.Track.TrackName)
+	}
+	return tracks
+}
+
+// queuedScrobbles returns the scrobbles still waiting to be submitted.
+func queuedScrobbles(t *testing.T, s *server) []*Scrobble {
+	t.Helper()
+	var scrobbles []*Scrobble
+	err := s.db.db.Order("id").Find(&scrobbles).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scrobbles
+}
+
+// createPlay creates an album with the given tracks and logs a play of it.
+func createPlay(t *testing.T, s *server, start time.Time, end *time.Time, tracks ...string) (*Log, *Album) {
+	t.Helper()
+	ctx := context.Background()
+
+	album := &Album{Name: "Discovery", Artist: "Daft Punk", Tracklist: strings.Join(tracks, "\n")}
+	err := s.db.CreateAlbum(ctx, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := &Log{Time: start, EndTime: end, AlbumID: album.ID}
+	err = s.db.SaveLog(ctx, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log, album
+}
+
+func TestSendScrobblesListenBrainz(t *testing.T) {
+	f, ts := newFakeListenBrainz(t, "lb-token")
+	s := newTestServer(t, config{listenBrainzURL: ts.URL, listenBrainzToken: "lb-token"})
+	ctx := context.Background()
+	sc := s.scrobblers[0]
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	log, album := createPlay(t, s, start, nil)
+	err := s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Server errors are retried later, waiting twice as long each time.
+	f.setStatus(http.StatusServiceUnavailable)
+	now := start.Add(time.Hour)
+	for attempt, wait := range []time.Duration{scrobbleBackoff, 2 * scrobbleBackoff} {
+		err = s.sendScrobbles(ctx, sc, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		queued := queuedScrobbles(t, s)
+		if len(queued) != 1 {
+			t.Fatalf("attempt %d: %d scrobbles queued, want 1", attempt+1, len(queued))
+		}
+		if queued[0].Attempts != attempt+1 || !queued[0].SendAt.Equal(now.Add(wait)) || queued[0].Error == "" {
+			t.Errorf("attempt %d: scrobble has %d attempts and is sent at %s (%q), want %d attempts at %s",
+				attempt+1, queued[0].Attempts, queued[0].SendAt, queued[0].Error, attempt+1, now.Add(wait))
+		}
+
+		// Scrobbles are not sent again before they are due.
+		err = s.sendScrobbles(ctx, sc, now.Add(wait-time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := queuedScrobbles(t, s); q[0].Attempts != attempt+1 {
+			t.Fatalf("attempt %d: scrobble retried before it was due", attempt+1)
+		}
+		now = now.Add(wait)
+	}
+
+	f.setStatus(http.StatusOK)
+	err = s.sendScrobbles(ctx, sc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 0 {
+		t.Errorf("%d scrobbles queued after they were submitted, want none", len(q))
+	}
+	if got := f.tracks(); !slices.Equal(got, []string{"Discovery"}) {
+		t.Errorf("submitted %v, want [Discovery]", got)
+	}
+}
+
+func TestSendScrobblesListenBrainzRejected(t *testing.T) {
+	f, ts := newFakeListenBrainz(t, "lb-token")
+	s := newTestServer(t, config{listenBrainzURL: ts.URL, listenBrainzToken: "lb-token"})
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	log, album := createPlay(t, s, start, nil)
+	err := s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad request would be refused again, so it is not retried.
+	f.setStatus(http.StatusBadRequest)
+	err = s.sendScrobbles(ctx, s.scrobblers[0], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 0 {
+		t.Errorf("%d scrobbles queued after they were rejected, want none", len(q))
+	}
+}
+
+func TestSendScrobblesTracks(t *testing.T) {
+	f, ts := newFakeListenBrainz(t, "lb-token")
+	s := newTestServer(t, config{listenBrainzURL: ts.URL, listenBrainzToken: "lb-token", scrobbleTracks: true})
+	ctx := context.Background()
+
+	// The play ends during the third track, so the last two were not played.
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	end := start.Add(2*scrobbleTrackLength + time.Minute)
+	log, album := createPlay(t, s, start, &end, "One More Time", "Aerodynamic", "Digital Love", "Harder, Better, Faster, Stronger", "Crescendolls")
+	err := s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 5 {
+		t.Fatalf("%d scrobbles queued, want 5", len(q))
+	}
+
+	err = s.sendScrobbles(ctx, s.scrobblers[0], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"One More Time", "Aerodynamic", "Digital Love"}
+	if got := f.tracks(); !slices.Equal(got, want) {
+		t.Errorf("submitted %v, want %v", got, want)
+	}
+	for i, l := range f.submitted() {
+		if want := start.Add(time.Duration(i) * scrobbleTrackLength).Unix(); l.ListenedAt != want {
+			t.Errorf("track %d listened at %d, want %d", i+1, l.ListenedAt, want)
+		}
+	}
+	if q := queuedScrobbles(t, s); len(q) != 0 {
+		t.Errorf("%d scrobbles queued after they were submitted or dropped, want none", len(q))
+	}
+}
+
+// lastfmTestSignature signs the parameters as documented by Last.fm, to check
+// the signature of the requests independently of lastfmSignature.
+func lastfmTestSignature(params url.Values, secret string) string {
+	var names []string
+	for name := range params {
+		if name != "format" && name != "callback" && name != "api_sig" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	s := ""
+	for _, name := range names {
+		s += name + params.Get(name)
+	}
+	hash := md5.Sum([]byte(s + secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestLastfmSignature(t *testing.T) {
+	params := url.Values{
+		"method":  {"auth.getMobileSession"},
+		"api_key": {"key"},
+		"format":  {"json"},
+	}
+	// md5("api_keykeymethodauth.getMobileSessionsecret")
+	want := "018322def6bdaf0b7eba8f03ac376100"
+	if got := lastfmSignature(params, "secret"); got != want {
+		t.Errorf("lastfmSignature() = %s, want %s", got, want)
+	}
+}
+
+func TestLastfmScrobble(t *testing.T) {
+	const (
+		apiKey     = "lf-key"
+		apiSecret  = "lf-secret"
+		sessionKey = "lf-session"
+	)
+
+	var mu sync.Mutex
+	var errorCode int
+	var submitted []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/2.0/" {
+			http.NotFound(w, r)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("api_key") != apiKey || r.PostForm.Get("sk") != sessionKey {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":9,"message":"Invalid session key"}`))
+			return
+		}
+		if r.PostForm.Get("api_sig") != lastfmTestSignature(r.PostForm, apiSecret) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":13,"message":"Invalid method signature supplied"}`))
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if errorCode != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": errorCode, "message": "Failed"})
+			return
+		}
+		submitted = append(submitted, r.PostForm)
+		_, _ = w.Write([]byte(`{"scrobbles":{"@attr":{"accepted":1,"ignored":0}}}`))
+	}))
+	defer ts.Close()
+
+	s := newTestServer(t, config{lastfmURL: ts.URL, lastfmAPIKey: apiKey, lastfmAPISecret: apiSecret, lastfmSessionKey: sessionKey})
+	ctx := context.Background()
+	sc := s.scrobblers[0]
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	log, album := createPlay(t, s, start, nil)
+	err := s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Service errors, such as 11 for being offline, are retried.
+	mu.Lock()
+	errorCode = 11
+	mu.Unlock()
+	err = s.sendScrobbles(ctx, sc, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 1 || q[0].Attempts != 1 {
+		t.Fatalf("scrobbles after a service error = %v, want one retried", q)
+	}
+
+	mu.Lock()
+	errorCode = 0
+	mu.Unlock()
+	err = s.sendScrobbles(ctx, sc, time.Now().Add(scrobbleBackoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 0 {
+		t.Errorf("%d scrobbles queued after they were submitted, want none", len(q))
+	}
+	mu.Lock()
+	requests := slices.Clone(submitted)
+	mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("%d scrobble requests, want 1", len(requests))
+	}
+	for name, want := range map[string]string{
+		"method":       "track.scrobble",
+		"artist[0]":    "Daft Punk",
+		"album[0]":     "Discovery",
+		"track[0]":     "Discovery",
+		"timestamp[0]": strconv.FormatInt(start.Unix(), 10),
+	} {
+		if got := requests[0].Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Invalid parameters would be refused again, so they are not retried.
+	log, album = createPlay(t, s, start, nil)
+	err = s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	errorCode = lastfmInvalidParameters
+	mu.Unlock()
+	err = s.sendScrobbles(ctx, sc, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := queuedScrobbles(t, s); len(q) != 0 {
+		t.Errorf("%d scrobbles queued after they were rejected, want none", len(q))
+	}
+}
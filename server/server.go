@@ -1,52 +1,148 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/jwtauth/v5"
 )
 
 type config struct {
+	tgAPIURL  string
 	tgToken   string
 	tgChatIDs []int64
+	tgBot     bool
 
-	apiToken string
-	dataDir  string
-	baseURL  string
+	webhookURLs  []string
+	ntfyURL      string
+	ntfyToken    string
+	gotifyURL    string
+	gotifyToken  string
+	smtpHost     string
+	smtpPort     int
+	smtpUsername string
+	smtpPassword string
+	smtpFrom     string
+	smtpTo       []string
+
+	musicBrainzURL string
+	discogsURL     string
+	discogsToken   string
+	coverArtURL    string
+
+	listenBrainzURL   string
+	listenBrainzToken string
+	lastfmURL         string
+	lastfmAPIKey      string
+	lastfmAPISecret   string
+	lastfmSessionKey  string
+	scrobbleTracks    bool
+
+	apiToken  string
+	dataDir   string
+	baseURL   string
+	nowPublic bool
 
-	jwtSecret string
-	username  string
-	password  string
+	playIdleTimeout time.Duration
+	playMinDuration time.Duration
+	dedupWindow     time.Duration
+
+	deviceOfflineTimeout time.Duration
+
+	secret          string
+	sessionLifetime time.Duration
+	username        string
+	password        string
+
+	loginMaxAttempts int
+	loginBackoff     time.Duration
+	loginLockout     time.Duration
+	trustedProxies   []string
 }
 
 type server struct {
-	mux     *chi.Mux
-	db      *database
-	baseURL string
+	mux      *chi.Mux
+	db       *database
+	baseURL  string
+	basePath string
+	apiToken string
 
-	tgToken   string
-	tgChatIDs []string
+	notifiers     []Notifier
+	notifications chan *Notification
+	telegram      *telegramBot
+
+	events    *eventBroker
+	nowPublic bool
+
+	scrobblers     []Scrobbler
+	scrobbleTracks bool
+
+	metadata       []MetadataProvider
+	enrichRequests chan struct{}
+	enrichMu       sync.Mutex
+	enrich         enrichStatus
+
+	templates *template.Template
+
+	coversDir   string
+	coverArtURL string
+
+	csrfKey         []byte
+	sessionLifetime time.Duration
+	username        string
+	password        string
+
+	attempts       *attemptLimiter
+	trustedProxies []netip.Prefix
 
-	jwtAuth  *jwtauth.JWTAuth
-	username string
-	password string
+	historyMu sync.Mutex
+	histories map[string]*historyImport
+
+	tagAssignmentMu sync.Mutex
+	tagAssignment   *tagAssignment
+
+	playsMu         sync.Mutex
+	playIdleTimeout time.Duration
+	playMinDuration time.Duration
+	dedupWindow     time.Duration
+
+	deviceOfflineTimeout time.Duration
 }
 
 func newServer(cfg *config) (*server, error) {
-	err := os.MkdirAll(cfg.dataDir, 0777)
+	err := os.MkdirAll(filepath.Join(cfg.dataDir, "covers"), 0777)
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := newDatabase(filepath.Join(cfg.dataDir, "data.sqlite3"))
+	db, err := newDatabase(filepath.Join(cfg.dataDir, databaseFile))
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := loadSecret(cfg.secret, cfg.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(cfg.baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url: %w", err)
+	}
+
+	trustedProxies, err := parseTrustedProxies(cfg.trustedProxies)
 	if err != nil {
 		return nil, err
 	}
@@ -57,57 +153,187 @@ func newServer(cfg *config) (*server, error) {
 	}
 
 	s := &server{
-		mux:      chi.NewRouter(),
-		db:       db,
-		baseURL:  cfg.baseURL,
-		tgToken:  cfg.tgToken,
-		jwtAuth:  jwtauth.New("HS256", []byte(base64.StdEncoding.EncodeToString([]byte(cfg.jwtSecret))), nil),
-		username: cfg.username,
-		password: string(pwd),
-	}
-	for _, chatID := range cfg.tgChatIDs {
-		s.tgChatIDs = append(s.tgChatIDs, strconv.FormatInt(chatID, 10))
-	}
-
-	// Build Router
-	s.mux.Use(jwtauth.Verifier(s.jwtAuth))
-	s.mux.Get("/assets*", http.FileServer(http.FS(assetsFS)).ServeHTTP)
-	s.mux.Get("/login", s.loginGet)
-	s.mux.Post("/login", s.loginPost)
-	s.mux.Get("/logout", s.logoutGet)
-	s.mux.Group(func(r chi.Router) {
+		db:        db,
+		baseURL:   strings.TrimSuffix(cfg.baseURL, "/"),
+		basePath:  strings.TrimSuffix(base.Path, "/"),
+		apiToken:  cfg.apiToken,
+		notifiers: newNotifiers(cfg),
+		csrfKey:   secret,
+		username:  cfg.username,
+		password:  string(pwd),
+
+		sessionLifetime: cfg.sessionLifetime,
+
+		attempts:       newAttemptLimiter(cfg.loginMaxAttempts, cfg.loginBackoff, cfg.loginLockout),
+		trustedProxies: trustedProxies,
+
+		histories: map[string]*historyImport{},
+
+		playIdleTimeout: cfg.playIdleTimeout,
+		playMinDuration: cfg.playMinDuration,
+		dedupWindow:     cfg.dedupWindow,
+
+		deviceOfflineTimeout: cfg.deviceOfflineTimeout,
+
+		notifications: make(chan *Notification, notificationQueueSize),
+
+		events:    newEventBroker(),
+		nowPublic: cfg.nowPublic,
+
+		scrobblers:     newScrobblers(cfg),
+		scrobbleTracks: cfg.scrobbleTracks,
+
+		metadata:       newMetadataProviders(cfg),
+		enrichRequests: make(chan struct{}, 1),
+
+		coversDir:   filepath.Join(cfg.dataDir, "covers"),
+		coverArtURL: strings.TrimSuffix(cfg.coverArtURL, "/"),
+	}
+	if cfg.tgToken != "" && len(cfg.tgChatIDs) != 0 {
+		s.telegram = newTelegramBot(s, cfg.tgAPIURL, cfg.tgToken, cfg.tgChatIDs, cfg.tgBot)
+		s.notifiers = append(s.notifiers, s.telegram)
+	} else if cfg.tgBot {
+		slog.Warn("telegram token or chat id not set, telegram bot is disabled")
+	}
+
+	if len(s.notifiers) == 0 {
+		slog.Warn("no notifiers configured, scans will not be notified")
+	}
+
+	s.templates, err = newTemplates(s.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build Router. Every route is served under the path of the base URL, so
+	// that the dashboard can share a domain with other apps behind a proxy.
+	router := chi.NewRouter()
+	if s.basePath == "" {
+		s.mux = router
+	} else {
+		s.mux = chi.NewRouter()
+		s.mux.Mount(s.basePath, router)
+	}
+
+	router.Get("/assets*", http.StripPrefix(s.basePath, http.FileServer(http.FS(assetsFS))).ServeHTTP)
+	router.Get("/covers/{name}", s.getCover)
+	router.Get("/login", s.loginGet)
+	router.Post("/login", s.loginPost)
+	router.Get("/logout", s.logoutGet)
+	router.With(s.mustLiveAccess(s.redirectToLogin)).Get("/now", s.getNow)
+	router.With(s.mustLiveAccess(unauthorizedApiEvents)).Get("/api/v1/events", s.getApiEvents)
+	router.Group(func(r chi.Router) {
 		r.Use(s.mustLoggedIn)
+		r.Use(s.mustCSRFToken)
 		r.Get("/", s.getIndex)
 		r.Get("/albums", s.getAlbums)
-		r.Get("/albums/new", s.getNewAlbum)
-		r.Post("/albums/new", s.postNewAlbum)
 		r.Get("/albums/{id}", s.getAlbum)
-		r.Post("/albums/{id}", s.postAlbum)
-		r.Get("/albums/{id}/delete", s.getDeleteAlbum)
-		r.Post("/albums/{id}/delete", s.postDeleteAlbum)
-
 		r.Get("/logs", s.getLogs)
-		r.Get("/logs/{id}/delete", s.getDeleteLog)
-		r.Post("/logs/{id}/delete", s.postDeleteLog)
+		r.Get("/logs/suppressed", s.getSuppressedScans)
+		r.Get("/inbox", s.getInbox)
+		r.Get("/inbox/{id}", s.getInboxScan)
+		r.Get("/stats", s.getStats)
+		r.Get("/transfer", s.getTransfer)
+		r.Get("/export/{file}", s.getExport)
+		r.Get("/sessions", s.getSessions)
+		r.Post("/sessions/revoke", s.postRevokeSessions)
+		r.Post("/sessions/{id}/revoke", s.postRevokeSession)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.mustRole(roleEditor))
+			r.Get("/albums/new", s.getNewAlbum)
+			r.Get("/albums/lookup", s.getAlbumLookup)
+			r.Post("/albums/enrich", s.postEnrichAlbums)
+			r.Post("/albums/new", s.postNewAlbum)
+			r.Post("/albums/{id}", s.postAlbum)
+			r.Post("/albums/{id}/assign-tag", s.postAssignTag)
+			r.Post("/albums/{id}/assign-tag/cancel", s.postCancelAssignTag)
+			r.Get("/albums/{id}/delete", s.getDeleteAlbum)
+			r.Post("/albums/{id}/delete", s.postDeleteAlbum)
+
+			r.Get("/logs/{id}/delete", s.getDeleteLog)
+			r.Post("/logs/{id}/delete", s.postDeleteLog)
+
+			r.Post("/inbox/{id}", s.postInboxScan)
+			r.Post("/inbox/{id}/dismiss", s.postDismissInboxScan)
+
+			r.Post("/import", s.postImport)
+			r.Post("/import/history", s.postImportHistory)
+			r.Get("/import/history/{id}", s.getImportHistory)
+			r.Post("/import/history/{id}", s.postConfirmHistory)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.mustRole(roleAdmin))
+			r.Get("/devices", s.getDevices)
+			r.Post("/devices", s.postNewDevice)
+			r.Get("/devices/{id}", s.getDevice)
+			r.Post("/devices/{id}", s.postDevice)
+			r.Get("/devices/{id}/token", s.getDeviceToken)
+			r.Post("/devices/{id}/token", s.postDeviceToken)
+			r.Get("/devices/{id}/delete", s.getDeleteDevice)
+			r.Post("/devices/{id}/delete", s.postDeleteDevice)
+
+			r.Get("/tokens", s.getTokens)
+			r.Post("/tokens", s.postNewToken)
+			r.Get("/tokens/{id}/revoke", s.getRevokeToken)
+			r.Post("/tokens/{id}/revoke", s.postRevokeToken)
+
+			r.Get("/users", s.getUsers)
+			r.Post("/users", s.postNewUser)
+			r.Get("/users/{id}", s.getUser)
+			r.Post("/users/{id}", s.postUser)
+			r.Get("/users/{id}/delete", s.getDeleteUser)
+			r.Post("/users/{id}/delete", s.postDeleteUser)
+		})
 	})
-	s.mux.Group(func(r chi.Router) {
-		if cfg.apiToken == "" {
-			slog.Warn("authorization token not set, api endpoint is unprotected")
-		} else {
-			r.Use(mustApiToken(cfg.apiToken))
-		}
+	router.Group(func(r chi.Router) {
+		r.Use(s.mustApiToken(scopeScan))
 		r.Post("/api/tag", s.postApiUpdate)
+		r.Post("/api/tag/heartbeat", s.postApiHeartbeat)
+		r.Post("/api/tag/removed", s.postApiRemoved)
+		r.Post("/api/device/heartbeat", s.postApiDeviceHeartbeat)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(s.mustApiToken(scopeRead))
+		r.Get("/api/v1/albums", s.getApiAlbums)
+		r.Get("/api/v1/albums/{id}", s.getApiAlbum)
+		r.Get("/api/v1/logs", s.getApiLogs)
+		r.Get("/api/v1/logs/{id}", s.getApiLog)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(s.mustApiToken(scopeWrite))
+		r.Post("/api/v1/albums", s.postApiAlbum)
+		r.Put("/api/v1/albums/{id}", s.putApiAlbum)
+		r.Delete("/api/v1/albums/{id}", s.deleteApiAlbum)
+		r.Post("/api/v1/logs", s.postApiLog)
+		r.Put("/api/v1/logs/{id}", s.putApiLog)
+		r.Delete("/api/v1/logs/{id}", s.deleteApiLog)
 	})
 
 	return s, nil
 }
 
+// Start runs the background jobs of the server until the context is cancelled.
+func (s *server) Start(ctx context.Context) {
+	go s.sendNotifications(ctx)
+	go s.watchIdlePlays(ctx)
+	go s.watchDevices(ctx)
+	go s.watchEnrichRequests(ctx)
+	go s.watchAttempts(ctx)
+	go s.watchScrobbles(ctx)
+
+	if s.telegram != nil && s.telegram.interactive {
+		go s.telegram.poll(ctx)
+	}
+}
+
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
 func (s *server) getIndex(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/albums", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, s.basePath+"/albums", http.StatusTemporaryRedirect)
 }
 
 type pagination struct {
@@ -147,29 +373,3 @@ func newPagination(r *http.Request, total int64, pageURL func(int) string) pagin
 
 	return p
 }
-
-func (s *server) sendToTelegram(msg string) {
-	for _, chatID := range s.tgChatIDs {
-		data := url.Values{}
-		data.Set("chat_id", chatID)
-		data.Set("disable_web_page_preview", "true")
-		data.Set("text", msg)
-
-		u, err := url.Parse(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", s.tgToken))
-		if err != nil {
-			slog.Warn("failed to send make telegram url", "error", err)
-			return
-		}
-		u.RawQuery = data.Encode()
-
-		resp, err := http.DefaultClient.Get(u.String())
-		if err != nil {
-			slog.Warn("failed to send request to telegram", "error", err)
-			return
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			slog.Warn("unexpected status code from telegram", "statusCode", resp.StatusCode)
-		}
-	}
-}
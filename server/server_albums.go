@@ -1,37 +1,73 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
 )
 
 const pageSize = 50
 
-func (s *server) getAlbums(w http.ResponseWriter, r *http.Request) {
+func parseAlbumsSort(r *http.Request) string {
 	sort := r.URL.Query().Get("sort")
 	if sort != "name" && sort != "artist" {
-		sort = "name"
+		return "name"
+	}
+	return sort
+}
+
+// parseAlbumsView returns whether the albums are shown as a table or as a
+// wall of covers.
+func parseAlbumsView(r *http.Request) string {
+	if r.URL.Query().Get("view") == "wall" {
+		return "wall"
+	}
+	return "table"
+}
+
+func parseAlbumFilter(r *http.Request) AlbumFilter {
+	return AlbumFilter{
+		Search: strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+}
+
+// query returns the filter as URL query parameters, ending with an ampersand
+// so that more parameters can be appended.
+func (f AlbumFilter) query() string {
+	if f.Search == "" {
+		return ""
 	}
+	return "q=" + url.QueryEscape(f.Search) + "&"
+}
+
+func (s *server) getAlbums(w http.ResponseWriter, r *http.Request) {
+	sort := parseAlbumsSort(r)
 	order := parseOrder(r, "asc")
+	view := parseAlbumsView(r)
+	filter := parseAlbumFilter(r)
 
-	total, err := s.db.CountAlbums(r.Context())
+	total, err := s.db.CountAlbums(r.Context(), filter)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
 	p := newPagination(r, total, func(pg int) string {
-		return fmt.Sprintf("/albums?sort=%s&order=%s&page=%d", sort, order, pg)
+		return fmt.Sprintf("%s/albums?%sview=%s&sort=%s&order=%s&page=%d", s.basePath, filter.query(), view, sort, order, pg)
 	})
 
-	albums, err := s.db.GetAlbums(r.Context(), sort, order, (p.Page-1)*pageSize, pageSize)
+	albums, err := s.db.GetAlbums(r.Context(), filter, sort, order, (p.Page-1)*pageSize, pageSize)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -44,125 +80,299 @@ func (s *server) getAlbums(w http.ResponseWriter, r *http.Request) {
 		artistOrder = "desc"
 	}
 
-	s.renderTemplate(w, http.StatusOK, "albums.html", map[string]interface{}{
+	s.renderTemplate(w, r, http.StatusOK, "albums.html", map[string]interface{}{
 		"Title":         "Albums",
 		"Albums":        albums,
 		"Total":         total,
 		"Sort":          sort,
 		"Order":         order,
-		"SortNameURL":   fmt.Sprintf("/albums?sort=name&order=%s&page=1", nameOrder),
-		"SortArtistURL": fmt.Sprintf("/albums?sort=artist&order=%s&page=1", artistOrder),
+		"View":          view,
+		"Filter":        filter,
+		"SortNameURL":   fmt.Sprintf("%s/albums?%sview=%s&sort=name&order=%s&page=1", s.basePath, filter.query(), view, nameOrder),
+		"SortArtistURL": fmt.Sprintf("%s/albums?%sview=%s&sort=artist&order=%s&page=1", s.basePath, filter.query(), view, artistOrder),
+		"TableURL":      fmt.Sprintf("%s/albums?%sview=table&sort=%s&order=%s&page=%d", s.basePath, filter.query(), sort, order, p.Page),
+		"WallURL":       fmt.Sprintf("%s/albums?%sview=wall&sort=%s&order=%s&page=%d", s.basePath, filter.query(), sort, order, p.Page),
 		"Pagination":    p,
+		"CanEnrich":     len(s.metadata) != 0,
+		"Enrich":        s.getEnrichStatus(),
 	})
 }
 
 func (s *server) getNewAlbum(w http.ResponseWriter, r *http.Request) {
-	s.renderTemplate(w, http.StatusOK, "album.html", map[string]interface{}{
-		"Title": "New Album",
-		"Log":   r.URL.Query().Get("log") == "true",
-		"Album": &Album{
-			Tag: r.URL.Query().Get("tag"),
-		},
+	q := r.URL.Query()
+	album := &Album{
+		Name:    q.Get("name"),
+		Artist:  q.Get("artist"),
+		Barcode: q.Get("barcode"),
+	}
+	for _, tag := range parseTags(q.Get("tags")) {
+		album.Tags = append(album.Tags, &AlbumTag{Tag: tag})
+	}
+
+	err := s.applyLookup(r, album)
+	if err != nil {
+		s.renderLookupError(w, r, err)
+		return
+	}
+
+	scan, code, err := s.unknownScanFromForm(r.Context(), q.Get("inbox"))
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "album.html", map[string]interface{}{
+		"Title":         "New Album",
+		"Log":           q.Get("log") == "true" || q.Get("log") == "on",
+		"UnknownScan":   scan,
+		"Album":         album,
+		"CanLookup":     len(s.metadata) != 0,
+		"CanFetchCover": s.coverArtURL != "",
 	})
 }
 
 func (s *server) postNewAlbum(w http.ResponseWriter, r *http.Request) {
-	s.createOrUpdateAlbum(w, r, nil)
+	s.createOrUpdateAlbum(w, r, &Album{})
 }
 
 func (s *server) getAlbum(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	album, err := s.db.GetAlbum(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	s.renderTemplate(w, http.StatusOK, "album.html", map[string]interface{}{
-		"Title": "Update Album",
-		"Album": album,
+	err = s.applyLookup(r, album)
+	if err != nil {
+		s.renderLookupError(w, r, err)
+		return
+	}
+
+	tagHistory, err := s.db.GetAlbumTagHistory(r.Context(), album.ID)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	title := "Update Album"
+	if !userFromContext(r.Context()).CanEdit() {
+		title = "Album"
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "album.html", map[string]interface{}{
+		"Title":         title,
+		"Album":         album,
+		"TagHistory":    tagHistory,
+		"TagAssignment": s.getTagAssignment(),
+		"CanLookup":     len(s.metadata) != 0,
+		"CanFetchCover": s.coverArtURL != "",
 	})
 }
 
 func (s *server) postAlbum(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	_, err = s.db.GetAlbum(r.Context(), id)
+	album, err := s.db.GetAlbum(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	s.createOrUpdateAlbum(w, r, &id)
+	s.createOrUpdateAlbum(w, r, album)
 }
 
-func (s *server) createOrUpdateAlbum(w http.ResponseWriter, r *http.Request, id *uint64) {
-	err := r.ParseForm()
-	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+// createOrUpdateAlbum updates the album from the form, creating it if it does
+// not have an ID yet.
+func (s *server) createOrUpdateAlbum(w http.ResponseWriter, r *http.Request, album *Album) {
+	err := r.ParseMultipartForm(maxCoverUpload)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	name := strings.TrimSpace(r.Form.Get("name"))
 	artist := strings.TrimSpace(r.Form.Get("artist"))
-	tag := strings.TrimSpace(r.Form.Get("tag"))
+	tags := parseTags(r.Form.Get("tags"))
+	moveTags := r.Form.Get("move_tags") == "on"
 
-	if name == "" || artist == "" || tag == "" {
-		s.renderError(w, http.StatusBadRequest, errors.New("name or artist or tag is missing"))
+	if name == "" || artist == "" {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("name or artist is missing"))
 		return
 	}
 
-	album := &Album{
-		Name:   name,
-		Artist: artist,
-		Tag:    tag,
+	year := 0
+	if value := strings.TrimSpace(r.Form.Get("year")); value != "" {
+		year, err = strconv.Atoi(value)
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid year: %w", err))
+			return
+		}
 	}
 
-	if id == nil {
+	album.Name = name
+	album.Artist = artist
+	album.Year = year
+	album.Label = strings.TrimSpace(r.Form.Get("label"))
+	album.CatalogNumber = strings.TrimSpace(r.Form.Get("catalog_number"))
+	album.Barcode = strings.TrimSpace(r.Form.Get("barcode"))
+	album.Genres = strings.Join(splitList(r.Form.Get("genres"), ","), ", ")
+	album.Tracklist = strings.Join(splitList(r.Form.Get("tracklist"), "\n"), "\n")
+	album.MBID = strings.TrimSpace(r.Form.Get("mbid"))
+
+	isNew := album.ID == 0
+	var scan *UnknownScan
+	if isNew {
+		var code int
+		scan, code, err = s.unknownScanFromForm(r.Context(), r.Form.Get("inbox"))
+		if err != nil {
+			s.renderError(w, r, code, err)
+			return
+		}
+	}
+
+	if !moveTags {
+		err = s.db.CheckAlbumTags(r.Context(), album.ID, tags)
+		if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	oldCover := album.Cover
+	code, err := s.updateCoverFromForm(r, album)
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+
+	if isNew {
 		err = s.db.CreateAlbum(r.Context(), album)
 	} else {
-		album.ID = *id
 		err = s.db.UpdateAlbum(r.Context(), album)
 	}
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		if album.Cover != oldCover {
+			s.removeCover(album.Cover)
+		}
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if id == nil && r.Form.Get("log") == "on" {
+	if album.Cover != oldCover {
+		s.removeCover(oldCover)
+	}
+
+	err = s.db.SetAlbumTags(r.Context(), album, tags, moveTags, time.Now())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if scan != nil {
+		_, err = s.assignUnknownScans(r.Context(), scan.Tag, album)
+		if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	} else if isNew && r.Form.Get("log") == "on" {
 		err = s.db.CreateLog(r.Context(), album)
 		if err != nil {
-			s.renderError(w, http.StatusInternalServerError, err)
+			s.renderError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 	}
 
-	http.Redirect(w, r, "/albums#"+strconv.FormatUint(album.ID, 10), http.StatusSeeOther)
+	http.Redirect(w, r, s.basePath+"/albums#"+strconv.FormatUint(album.ID, 10), http.StatusSeeOther)
+}
+
+// unknownScanFromForm returns the unknown scan that a new album is created
+// for, if any, given its ID. On error, it returns the status code to respond
+// with.
+func (s *server) unknownScanFromForm(ctx context.Context, value string) (*UnknownScan, int, error) {
+	if value == "" {
+		return nil, 0, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid unknown scan: %w", err)
+	}
+
+	scan, err := s.db.GetUnknownScan(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, http.StatusBadRequest, errors.New("the unknown scan is no longer in the inbox")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return scan, 0, nil
+}
+
+// updateCoverFromForm sets the cover uploaded in the form or, if requested,
+// the one fetched from the Cover Art Archive. On error, it returns the status
+// code to respond with.
+func (s *server) updateCoverFromForm(r *http.Request, album *Album) (int, error) {
+	var data []byte
+
+	file, _, err := r.FormFile("cover")
+	if err == nil {
+		defer file.Close()
+		data, err = io.ReadAll(file)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		return http.StatusBadRequest, err
+	} else if r.Form.Get("fetch_cover") == "on" {
+		if album.MBID == "" {
+			return http.StatusBadRequest, errors.New("a MusicBrainz ID is needed to fetch the cover")
+		}
+
+		data, err = s.fetchCover(r.Context(), album.MBID)
+		if errors.Is(err, errNoCover) {
+			return http.StatusNotFound, errors.New("the release has no cover in the Cover Art Archive")
+		} else if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("could not fetch cover: %w", err)
+		}
+	} else if r.Form.Get("remove_cover") == "on" {
+		album.Cover = ""
+		return 0, nil
+	} else {
+		return 0, nil
+	}
+
+	key, err := s.saveCover(data)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	album.Cover = key
+	return 0, nil
 }
 
 func (s *server) getDeleteAlbum(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	album, err := s.db.GetAlbum(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	s.renderTemplate(w, http.StatusOK, "album-delete.html", map[string]interface{}{
+	s.renderTemplate(w, r, http.StatusOK, "album-delete.html", map[string]interface{}{
 		"Title": "Delete Album",
 		"Album": album,
 	})
@@ -171,17 +381,17 @@ func (s *server) getDeleteAlbum(w http.ResponseWriter, r *http.Request) {
 func (s *server) postDeleteAlbum(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	err = s.db.DeleteAlbum(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.Redirect(w, r, "/albums", http.StatusSeeOther)
+	http.Redirect(w, r, s.basePath+"/albums", http.StatusSeeOther)
 }
 
 func extractID(r *http.Request) (uint64, error) {
@@ -2,63 +2,303 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+const (
+	tagStatusKnown     = "known"
+	tagStatusUnknown   = "unknown"
+	tagStatusDuplicate = "duplicate"
+	tagStatusAssigned  = "assigned"
+	tagStatusError     = "error"
+)
+
+// apiTagResponse tells the shelf what happened with the scanned tag.
+type apiTagResponse struct {
+	Status string    `json:"status"`
+	Tag    string    `json:"tag"`
+	Album  *apiAlbum `json:"album,omitempty"`
+	LogID  uint64    `json:"log_id,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
 func (s *server) postApiUpdate(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, http.StatusInternalServerError, &apiTagResponse{Status: tagStatusError, Error: err.Error()})
 		return
 	}
 
 	tagID := string(body)
-	slog.Info("received new tag", "tag", tagID)
-	w.WriteHeader(http.StatusOK)
+	device := s.apiDevice(r)
+	slog.Info("received new tag", "tag", tagID, "device", device)
 
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
+	// The scan is processed even if the shelf gives up waiting for the
+	// response, so that it is not left half done.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Second*30)
+	defer cancel()
 
-		album, err := s.db.GetAlbumByTag(ctx, tagID)
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				link := fmt.Sprintf("%s/albums/new?log=true&tag=%s", s.baseURL, tagID)
-				message := fmt.Sprintf("Unknown tag scanned: %s.\n\nCreate new album at %s.", tagID, link)
-				s.sendToTelegram(message)
-			} else {
-				slog.Error("could not load album", "error", err)
-				s.sendToTelegram(fmt.Sprintf("Could not load albums: %s", err))
-			}
+	res := s.scanTag(ctx, tagID, device)
+	if res.Status == tagStatusError {
+		writeJSON(w, http.StatusInternalServerError, res)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// scanTag starts a play for the album with the tag, and queues the
+// notifications about it. An unknown tag is stuck on the album waiting for
+// its tag, if any, without starting a play.
+func (s *server) scanTag(ctx context.Context, tagID string, device *Device) *apiTagResponse {
+	album, err := s.db.GetAlbumByTag(ctx, tagID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		album, err = s.assignTag(ctx, tagID)
+		if err == nil {
+			return &apiTagResponse{Status: tagStatusAssigned, Tag: tagID, Album: newApiAlbum(album, s.basePath)}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("could not assign tag", "error", err)
+			s.notifyError(tagID, fmt.Sprintf("Could not assign tag: %s", err))
+			return &apiTagResponse{Status: tagStatusError, Tag: tagID, Error: err.Error()}
+		}
 
-			return
+		err = s.stopPlay(ctx, device)
+		if err != nil {
+			slog.Error("could not end play", "error", err)
 		}
 
-		s.sendToTelegram("Scanned vinyl " + album.String())
-		err = s.db.CreateLog(ctx, album)
+		s.publishUnknownTag(tagID, device)
+
+		// The scan is kept in the inbox, so that its play can be logged once
+		// the tag is assigned to an album. Repeated scans of the tag are only
+		// notified once.
+		scan, created, err := s.db.CreateUnknownScan(ctx, tagID, device, s.dedupWindow, time.Now())
 		if err != nil {
-			slog.Error("could not log album", "error", err)
-			s.sendToTelegram(fmt.Sprintf("Could not log album: %s", err))
+			slog.Error("could not save unknown scan", "error", err)
+			s.notifyError(tagID, fmt.Sprintf("Could not save unknown scan: %s", err))
+			return &apiTagResponse{Status: tagStatusError, Tag: tagID, Error: err.Error()}
+		}
+		if !created {
+			slog.Info("repeated unknown scan", "tag", tagID, "scan", scan.ID, "scans", scan.Scans)
+			return &apiTagResponse{Status: tagStatusUnknown, Tag: tagID}
 		}
-	}()
+
+		s.queueNotification(&Notification{
+			Event:   eventUnknownTag,
+			Title:   "Unknown tag scanned",
+			Message: fmt.Sprintf("Unknown tag scanned%s: %s. Assign it to an album at the link below.", onDevice(device), tagID),
+			URL:     fmt.Sprintf("%s/inbox/%d", s.baseURL, scan.ID),
+			Tag:     tagID,
+			Device:  device,
+		})
+
+		return &apiTagResponse{Status: tagStatusUnknown, Tag: tagID}
+	} else if err != nil {
+		slog.Error("could not load album", "error", err)
+		s.notifyError(tagID, fmt.Sprintf("Could not load albums: %s", err))
+		return &apiTagResponse{Status: tagStatusError, Tag: tagID, Error: err.Error()}
+	}
+
+	res := &apiTagResponse{Status: tagStatusKnown, Tag: tagID, Album: newApiAlbum(album, s.basePath)}
+
+	log, duplicate, err := s.startPlay(ctx, album, tagID, device)
+	if err != nil {
+		slog.Error("could not log album", "error", err)
+		s.notifyError(tagID, fmt.Sprintf("Could not log album: %s", err))
+		res.Status = tagStatusError
+		res.Error = err.Error()
+		return res
+	}
+
+	res.LogID = log.ID
+	if duplicate {
+		res.Status = tagStatusDuplicate
+		return res
+	}
+
+	err = s.queueScrobbles(ctx, log, album)
+	if err != nil {
+		slog.Error("could not queue scrobbles", "error", err)
+	}
+
+	n := &Notification{
+		Event:   eventScan,
+		Title:   "Scanned vinyl",
+		Message: "Scanned vinyl " + album.String() + onDevice(device),
+		Tag:     tagID,
+		Album:   album,
+		Device:  device,
+	}
+	if album.Cover != "" {
+		n.CoverURL = s.baseURL + album.ThumbnailURL()
+		n.CoverFile = s.coverPath(album.Cover, true)
+	}
+	s.queueNotification(n)
+
+	return res
+}
+
+func (s *server) postApiHeartbeat(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = s.touchPlay(r.Context(), string(body), s.apiDevice(r))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("could not update play", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) postApiRemoved(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tagID := string(body)
+	device := s.apiDevice(r)
+	slog.Info("received tag removal", "tag", tagID, "device", device)
+
+	err = s.removePlay(r.Context(), tagID, device)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("could not end play", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
-func mustApiToken(token string) func(next http.Handler) http.Handler {
+type apiTokenContextKey struct{}
+
+// mustApiToken only lets through the requests authenticated with an API token
+// that has the given scope.
+func (s *server) mustApiToken(scope string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Header.Get("Authorization") != "Token "+token {
-				w.WriteHeader(http.StatusUnauthorized)
+			key := apiIPKey(s.clientIP(r))
+			if wait := s.attempts.begin(time.Now(), key); wait > 0 {
+				retryAfter(w, wait)
+				writeJSONError(w, http.StatusTooManyRequests, errTooManyAttempts)
+				return
+			}
+
+			token, err := s.authenticateApiToken(r)
+			if err != nil {
+				s.attempts.release(key)
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if token == nil {
+				s.failAttempt(key)
+				writeJSONError(w, http.StatusUnauthorized, errors.New("invalid api token"))
 				return
 			}
+			s.attempts.release(key)
 
-			next.ServeHTTP(w, r)
+			if !token.HasScope(scope) {
+				writeJSONError(w, http.StatusForbidden, fmt.Errorf("api token does not have the %s scope", scope))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), apiTokenContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// authenticateApiToken returns the API token in the Authorization header, or
+// nil if there is no valid token. The token from the configuration is accepted
+// too, and has every scope.
+func (s *server) authenticateApiToken(r *http.Request) (*ApiToken, error) {
+	value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	return s.findApiToken(r.Context(), value)
+}
+
+// findApiToken returns the API token with the given value, or nil if there is
+// none.
+func (s *server) findApiToken(ctx context.Context, value string) (*ApiToken, error) {
+	if s.apiToken != "" && subtle.ConstantTimeCompare([]byte(value), []byte(s.apiToken)) == 1 {
+		return &ApiToken{Name: "configuration", Scopes: strings.Join(allScopes, ",")}, nil
+	}
+
+	tokens, err := s.db.GetApiTokens(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare against every token, so that the time taken does not depend on
+	// which token matched.
+	var match *ApiToken
+	hash := []byte(hashApiToken(value))
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(token.Hash)) == 1 {
+			match = token
+		}
+	}
+
+	if match == nil {
+		return nil, nil
+	}
+
+	// The last used timestamp does not need to be precise, and the shelf may
+	// call the API quite often.
+	now := time.Now()
+	if match.LastUsedAt == nil || now.Sub(*match.LastUsedAt) > time.Minute {
+		err = s.db.TouchApiToken(ctx, match, now)
+		if err != nil {
+			slog.Warn("could not update api token last use", "error", err)
+		}
+	}
+
+	return match, nil
+}
+
+func apiTokenFromContext(ctx context.Context) *ApiToken {
+	token, _ := ctx.Value(apiTokenContextKey{}).(*ApiToken)
+	return token
+}
+
+func generateApiToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "vs_" + hex.EncodeToString(b), nil
+}
+
+func hashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
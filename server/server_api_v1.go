@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type apiAlbum struct {
+	ID            uint64    `json:"id"`
+	Name          string    `json:"name"`
+	Artist        string    `json:"artist"`
+	Tag           string    `json:"tag,omitempty"`
+	Tags          []string  `json:"tags"`
+	Year          int       `json:"year,omitempty"`
+	Label         string    `json:"label,omitempty"`
+	CatalogNumber string    `json:"catalog_number,omitempty"`
+	Barcode       string    `json:"barcode,omitempty"`
+	Genres        []string  `json:"genres,omitempty"`
+	Tracklist     []string  `json:"tracklist,omitempty"`
+	MBID          string    `json:"mbid,omitempty"`
+	CoverURL      string    `json:"cover_url,omitempty"`
+	ThumbnailURL  string    `json:"thumbnail_url,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// newApiAlbum returns the album as sent by the API. The URLs of its cover
+// start with base, which is the base URL or its path.
+func newApiAlbum(album *Album, base string) *apiAlbum {
+	a := &apiAlbum{
+		ID:            album.ID,
+		Name:          album.Name,
+		Artist:        album.Artist,
+		Tags:          album.TagList(),
+		Year:          album.Year,
+		Label:         album.Label,
+		CatalogNumber: album.CatalogNumber,
+		Barcode:       album.Barcode,
+		Genres:        album.GenreList(),
+		Tracklist:     album.TrackList(),
+		MBID:          album.MBID,
+		CreatedAt:     album.CreatedAt,
+		UpdatedAt:     album.UpdatedAt,
+	}
+	// The first tag is kept under its own field for the clients from
+	// before albums could have several tags.
+	if len(a.Tags) != 0 {
+		a.Tag = a.Tags[0]
+	}
+	if album.Cover != "" {
+		a.CoverURL = base + album.CoverURL()
+		a.ThumbnailURL = base + album.ThumbnailURL()
+	}
+	return a
+}
+
+type apiDevice struct {
+	ID       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+func newApiDevice(device *Device) *apiDevice {
+	return &apiDevice{
+		ID:       device.ID,
+		Name:     device.Name,
+		Location: device.Location,
+	}
+}
+
+type apiLog struct {
+	ID       uint64     `json:"id"`
+	Time     time.Time  `json:"time"`
+	EndTime  *time.Time `json:"end_time"`
+	Duration float64    `json:"duration"`
+	AlbumID  uint64     `json:"album_id"`
+	Album    *apiAlbum  `json:"album"`
+	DeviceID *uint64    `json:"device_id"`
+	Device   *apiDevice `json:"device"`
+}
+
+func newApiLog(log *Log, base string) *apiLog {
+	l := &apiLog{
+		ID:       log.ID,
+		Time:     log.Time,
+		EndTime:  log.EndTime,
+		Duration: log.Duration().Seconds(),
+		AlbumID:  log.AlbumID,
+		Album:    newApiAlbum(&log.Album, base),
+		DeviceID: log.DeviceID,
+	}
+	if log.Device != nil {
+		l.Device = newApiDevice(log.Device)
+	}
+	return l
+}
+
+type apiPagination struct {
+	Total      int64  `json:"total"`
+	Page       int    `json:"page"`
+	TotalPages int    `json:"total_pages"`
+	Prev       string `json:"prev,omitempty"`
+	Next       string `json:"next,omitempty"`
+}
+
+func newApiPagination(p pagination, total int64) apiPagination {
+	return apiPagination{
+		Total:      total,
+		Page:       p.Page,
+		TotalPages: p.TotalPages,
+		Prev:       p.PrevURL,
+		Next:       p.NextURL,
+	}
+}
+
+func (s *server) getApiAlbums(w http.ResponseWriter, r *http.Request) {
+	sort := parseAlbumsSort(r)
+	order := parseOrder(r, "asc")
+	filter := parseAlbumFilter(r)
+
+	total, err := s.db.CountAlbums(r.Context(), filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := newPagination(r, total, func(pg int) string {
+		return fmt.Sprintf("%s/api/v1/albums?%ssort=%s&order=%s&page=%d", s.basePath, filter.query(), sort, order, pg)
+	})
+
+	albums, err := s.db.GetAlbums(r.Context(), filter, sort, order, (p.Page-1)*pageSize, pageSize)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := struct {
+		apiPagination
+		Albums []*apiAlbum `json:"albums"`
+	}{apiPagination: newApiPagination(p, total), Albums: []*apiAlbum{}}
+	for _, album := range albums {
+		res.Albums = append(res.Albums, newApiAlbum(album, s.basePath))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) getApiAlbum(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	album, err := s.db.GetAlbum(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newApiAlbum(album, s.basePath))
+}
+
+func (s *server) postApiAlbum(w http.ResponseWriter, r *http.Request) {
+	album, tags, moveTags, err := decodeApiAlbum(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !moveTags {
+		err = s.db.CheckAlbumTags(r.Context(), 0, tags)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	err = s.db.CreateAlbum(r.Context(), album)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.db.SetAlbumTags(r.Context(), album, tags, moveTags, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newApiAlbum(album, s.basePath))
+}
+
+func (s *server) putApiAlbum(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	album, err := s.db.GetAlbum(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	update, tags, moveTags, err := decodeApiAlbum(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !moveTags {
+		err = s.db.CheckAlbumTags(r.Context(), album.ID, tags)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	album.Name = update.Name
+	album.Artist = update.Artist
+	album.Year = update.Year
+	album.Label = update.Label
+	album.CatalogNumber = update.CatalogNumber
+	album.Barcode = update.Barcode
+	album.Genres = update.Genres
+	album.Tracklist = update.Tracklist
+	album.MBID = update.MBID
+
+	err = s.db.UpdateAlbum(r.Context(), album)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if tags != nil {
+		err = s.db.SetAlbumTags(r.Context(), album, tags, moveTags, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, newApiAlbum(album, s.basePath))
+}
+
+func (s *server) deleteApiAlbum(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, err = s.db.GetAlbum(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.db.DeleteAlbum(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeApiAlbum returns the album of the request, its tags, which are nil if
+// the request does not set them, and whether to move the tags that are on
+// other albums. The tags are either a list, or a single tag, as sent by the
+// clients from before albums could have several.
+func decodeApiAlbum(r *http.Request) (*Album, []string, bool, error) {
+	var req struct {
+		Name          string    `json:"name"`
+		Artist        string    `json:"artist"`
+		Tag           *string   `json:"tag"`
+		Tags          *[]string `json:"tags"`
+		MoveTags      bool      `json:"move_tags"`
+		Year          int       `json:"year"`
+		Label         string    `json:"label"`
+		CatalogNumber string    `json:"catalog_number"`
+		Barcode       string    `json:"barcode"`
+		Genres        []string  `json:"genres"`
+		Tracklist     []string  `json:"tracklist"`
+		MBID          string    `json:"mbid"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	album := &Album{
+		Name:          strings.TrimSpace(req.Name),
+		Artist:        strings.TrimSpace(req.Artist),
+		Year:          req.Year,
+		Label:         strings.TrimSpace(req.Label),
+		CatalogNumber: strings.TrimSpace(req.CatalogNumber),
+		Barcode:       strings.TrimSpace(req.Barcode),
+		Genres:        strings.Join(splitList(strings.Join(req.Genres, ","), ","), ", "),
+		Tracklist:     strings.Join(splitList(strings.Join(req.Tracklist, "\n"), "\n"), "\n"),
+		MBID:          strings.TrimSpace(req.MBID),
+	}
+
+	if album.Name == "" || album.Artist == "" {
+		return nil, nil, false, errors.New("name or artist is missing")
+	}
+
+	var tags []string
+	if req.Tags != nil {
+		tags = append([]string{}, parseTags(strings.Join(*req.Tags, ","))...)
+	} else if req.Tag != nil {
+		tags = append([]string{}, parseTags(*req.Tag)...)
+	}
+
+	return album, tags, req.MoveTags, nil
+}
+
+func (s *server) getApiLogs(w http.ResponseWriter, r *http.Request) {
+	order := parseOrder(r, "desc")
+	filter := parseLogFilter(r)
+
+	total, err := s.db.CountLogs(r.Context(), filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := newPagination(r, total, func(pg int) string {
+		return fmt.Sprintf("%s/api/v1/logs?%sorder=%s&page=%d", s.basePath, filter.query(), order, pg)
+	})
+
+	logs, err := s.db.GetLogs(r.Context(), filter, order, (p.Page-1)*pageSize, pageSize)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := struct {
+		apiPagination
+		Logs []*apiLog `json:"logs"`
+	}{apiPagination: newApiPagination(p, total), Logs: []*apiLog{}}
+	for _, log := range logs {
+		res.Logs = append(res.Logs, newApiLog(log, s.basePath))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) getApiLog(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	log, err := s.db.GetLog(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newApiLog(log, s.basePath))
+}
+
+func (s *server) postApiLog(w http.ResponseWriter, r *http.Request) {
+	log := &Log{}
+	s.createOrUpdateApiLog(w, r, log, http.StatusCreated)
+}
+
+func (s *server) putApiLog(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	log, err := s.db.GetLog(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.createOrUpdateApiLog(w, r, log, http.StatusOK)
+}
+
+func (s *server) createOrUpdateApiLog(w http.ResponseWriter, r *http.Request, log *Log, code int) {
+	var req struct {
+		AlbumID uint64     `json:"album_id"`
+		Time    *time.Time `json:"time"`
+		EndTime *time.Time `json:"end_time"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.AlbumID == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("album_id is missing"))
+		return
+	}
+
+	album, err := s.db.GetAlbum(r.Context(), req.AlbumID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSONError(w, http.StatusBadRequest, errors.New("album does not exist"))
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.AlbumID = album.ID
+	log.Album = *album
+	if req.Time != nil {
+		log.Time = *req.Time
+	} else if log.ID == 0 {
+		log.Time = time.Now()
+	}
+	if req.EndTime != nil {
+		if req.EndTime.Before(log.Time) {
+			writeJSONError(w, http.StatusBadRequest, errors.New("end_time is before time"))
+			return
+		}
+		log.EndTime = req.EndTime
+	}
+
+	err = s.db.SaveLog(r.Context(), log)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, code, newApiLog(log, s.basePath))
+}
+
+func (s *server) deleteApiLog(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, err = s.db.GetLog(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.deleteLog(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		slog.Error("serving json", "error", err)
+	}
+}
+
+// writeJSONError writes the error as a JSON object. Like renderError, the
+// status code is adjusted for known database errors.
+func writeJSONError(w http.ResponseWriter, code int, reqErr error) {
+	code = errorStatusCode(code, reqErr)
+	if code >= http.StatusInternalServerError {
+		slog.Error("serving json", "error", reqErr)
+	}
+
+	writeJSON(w, code, map[string]string{
+		"error": reqErr.Error(),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testApiToken = "test-api-token"
+
+// serveApi handles the API request with the token of the configuration.
+func serveApi(s *server, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Token "+testApiToken)
+	r.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestApiAlbumTagOnAnotherAlbum(t *testing.T) {
+	s := newTestServer(t, config{apiToken: testApiToken})
+	ctx := context.Background()
+
+	w := serveApi(s, http.MethodPost, "/api/v1/albums", `{"name":"Discovery","artist":"Daft Punk","tags":["A"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	// A new album with a tag on another album is not created.
+	w = serveApi(s, http.MethodPost, "/api/v1/albums", `{"name":"Homework","artist":"Daft Punk","tag":"A"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("POST status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	total, err := s.db.CountAlbums(ctx, AlbumFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("%d albums, want 1", total)
+	}
+
+	w = serveApi(s, http.MethodPost, "/api/v1/albums", `{"name":"Homework","artist":"Daft Punk"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	homework, err := s.db.GetAlbumByName(ctx, "Homework", "Daft Punk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/v1/albums/%d", homework.ID)
+
+	w = serveApi(s, http.MethodPut, target, `{"name":"Homework (Remastered)","artist":"Daft Punk","tags":["A","B"]}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("PUT status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	homework, err = s.db.GetAlbum(ctx, homework.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if homework.Name != "Homework" || len(homework.Tags) != 0 {
+		t.Errorf("album was changed to %s with tags %v", homework.String(), homework.TagList())
+	}
+
+	w = serveApi(s, http.MethodPut, target, `{"name":"Homework","artist":"Daft Punk","tags":["A","B"],"move_tags":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	assertAlbumTags(t, s, homework.ID, "A", "B")
+}
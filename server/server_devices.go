@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// apiDevice returns the device authenticated in the API request, or nil if the
+// API token does not belong to a device.
+func (s *server) apiDevice(r *http.Request) *Device {
+	token := apiTokenFromContext(r.Context())
+	if token == nil || token.ID == 0 {
+		return nil
+	}
+
+	device, err := s.db.GetDeviceByApiToken(r.Context(), token.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		slog.Error("could not load device", "error", err)
+		return nil
+	}
+
+	if device.Offline {
+		err = s.db.SetDeviceOffline(r.Context(), device, false)
+		if err != nil {
+			slog.Warn("could not update device status", "error", err)
+		}
+
+		s.queueNotification(&Notification{
+			Event:   eventDeviceOnline,
+			Title:   "Device online",
+			Message: fmt.Sprintf("The device %s is back online.", device),
+			Device:  device,
+		})
+	}
+
+	now := time.Now()
+	if device.LastSeenAt == nil || now.Sub(*device.LastSeenAt) > time.Minute {
+		err = s.db.TouchDevice(r.Context(), device, now)
+		if err != nil {
+			slog.Warn("could not update device last seen", "error", err)
+		}
+	}
+
+	return device
+}
+
+// postApiDeviceHeartbeat saves the status reported by the device.
+func (s *server) postApiDeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
+	device := s.apiDevice(r)
+	if device == nil {
+		writeJSONError(w, http.StatusForbidden, errors.New("api token does not belong to a device"))
+		return
+	}
+
+	var req struct {
+		FirmwareVersion string `json:"firmware_version"`
+		Uptime          int64  `json:"uptime"`
+		RSSI            int    `json:"rssi"`
+		NFCStatus       string `json:"nfc_status"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	device.LastSeenAt = &now
+	device.HeartbeatAt = &now
+	device.FirmwareVersion = strings.TrimSpace(req.FirmwareVersion)
+	device.Uptime = time.Duration(req.Uptime) * time.Second
+	device.RSSI = req.RSSI
+	device.NFCStatus = strings.TrimSpace(req.NFCStatus)
+
+	err = s.db.SaveDeviceHeartbeat(r.Context(), device)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// watchDevices periodically notifies the devices that were not seen for
+// longer than the offline timeout, until the context is cancelled.
+func (s *server) watchDevices(ctx context.Context) {
+	if s.deviceOfflineTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(s.deviceOfflineTimeout, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := s.notifyOfflineDevices(ctx, now)
+			if err != nil {
+				slog.Error("could not check devices", "error", err)
+			}
+		}
+	}
+}
+
+func (s *server) notifyOfflineDevices(ctx context.Context, now time.Time) error {
+	devices, err := s.db.GetSilentDevices(ctx, now.Add(-s.deviceOfflineTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		err = s.db.SetDeviceOffline(ctx, device, true)
+		if err != nil {
+			return err
+		}
+
+		slog.Warn("device is offline", "device", device, "last_seen", device.LastSeenAt)
+		s.notify(ctx, &Notification{
+			Event:   eventDeviceOffline,
+			Title:   "Device offline",
+			Message: fmt.Sprintf("The device %s was last seen %s ago.", device, formatDuration(now.Sub(*device.LastSeenAt))),
+			URL:     s.baseURL + "/devices",
+			Device:  device,
+		})
+	}
+
+	return nil
+}
+
+// onDevice describes where a scan happened, for notifications.
+func onDevice(device *Device) string {
+	if device == nil {
+		return ""
+	}
+	return " on " + device.String()
+}
+
+func (s *server) getDevices(w http.ResponseWriter, r *http.Request) {
+	s.renderDevices(w, r, http.StatusOK, "")
+}
+
+func (s *server) renderDevices(w http.ResponseWriter, r *http.Request, code int, newToken string) {
+	devices, err := s.db.GetDevices(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, code, "devices.html", map[string]interface{}{
+		"Title":    "Devices",
+		"Devices":  devices,
+		"NewToken": newToken,
+	})
+}
+
+func (s *server) postNewDevice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	location := strings.TrimSpace(r.Form.Get("location"))
+
+	if name == "" {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("name is missing"))
+		return
+	}
+
+	value, err := generateApiToken()
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	device := &Device{
+		Name:     name,
+		Location: location,
+		ApiToken: ApiToken{
+			Name:   "Device: " + name,
+			Prefix: value[:10],
+			Hash:   hashApiToken(value),
+			Scopes: scopeScan,
+		},
+	}
+
+	err = s.db.CreateDevice(r.Context(), device)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The token is only shown once, as only its hash is stored.
+	s.renderDevices(w, r, http.StatusCreated, value)
+}
+
+func (s *server) getDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderDevice(w, r, http.StatusOK, device, "")
+}
+
+func (s *server) renderDevice(w http.ResponseWriter, r *http.Request, code int, device *Device, newToken string) {
+	s.renderTemplate(w, r, code, "device.html", map[string]interface{}{
+		"Title":    "Update Device",
+		"Device":   device,
+		"NewToken": newToken,
+	})
+}
+
+func (s *server) postDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device.Name = strings.TrimSpace(r.Form.Get("name"))
+	device.Location = strings.TrimSpace(r.Form.Get("location"))
+
+	if device.Name == "" {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("name is missing"))
+		return
+	}
+
+	err = s.db.UpdateDevice(r.Context(), device)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/devices", http.StatusSeeOther)
+}
+
+func (s *server) getDeviceToken(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "device-token.html", map[string]interface{}{
+		"Title":  "Regenerate API Token",
+		"Device": device,
+	})
+}
+
+// postDeviceToken replaces the API token of the device with a new one, which
+// revokes the current one.
+func (s *server) postDeviceToken(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	value, err := generateApiToken()
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	device.ApiToken.Prefix = value[:10]
+	device.ApiToken.Hash = hashApiToken(value)
+	device.ApiToken.LastUsedAt = nil
+
+	err = s.db.ReplaceApiToken(r.Context(), &device.ApiToken)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The token is only shown once, as only its hash is stored.
+	s.renderDevice(w, r, http.StatusOK, device, value)
+}
+
+func (s *server) getDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "device-delete.html", map[string]interface{}{
+		"Title":  "Delete Device",
+		"Device": device,
+	})
+}
+
+func (s *server) postDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	device, err := s.db.GetDevice(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.db.DeleteDevice(r.Context(), device)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/devices", http.StatusSeeOther)
+}
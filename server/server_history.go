@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// postImportHistory reads a Discogs or Last.fm export and matches it to the
+// collection, to be confirmed on its preview before anything is imported.
+func (s *server) postImportHistory(w http.ResponseWriter, r *http.Request) {
+	f, _, code, err := importUpload(r)
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+	defer f.Close()
+
+	source := r.Form.Get("source")
+	albums, err := readHistory(f, source)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	existing, err := s.db.GetAlbums(r.Context(), AlbumFilter{}, "name", "asc", 0, -1)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	matchHistory(albums, existing)
+
+	h := &historyImport{Source: source, Albums: albums}
+	err = s.saveHistory(h)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/import/history/"+h.ID, http.StatusSeeOther)
+}
+
+func (s *server) getImportHistory(w http.ResponseWriter, r *http.Request) {
+	h := s.loadHistory(chi.URLParam(r, "id"))
+	if h == nil {
+		s.renderError(w, r, http.StatusNotFound, errors.New("the import expired, upload the file again"))
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "history.html", map[string]interface{}{
+		"Title":   "Import History",
+		"History": h,
+		"Lastfm":  h.Source == sourceLastfm,
+	})
+}
+
+// postConfirmHistory imports the previewed history, with the fuzzy matches
+// that were confirmed. Each preview is only imported once.
+func (s *server) postConfirmHistory(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	confirmed := map[int]bool{}
+	for _, value := range r.Form["confirm"] {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		confirmed[i] = true
+	}
+
+	h := s.takeHistory(chi.URLParam(r, "id"))
+	if h == nil {
+		s.renderError(w, r, http.StatusNotFound, errors.New("the import expired, upload the file again"))
+		return
+	}
+
+	report, err := importHistory(r.Context(), s.db, h, func(i int) bool { return confirmed[i] })
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTransfer(w, r, http.StatusOK, report)
+}
+
+// saveHistory keeps the history until it is confirmed or expires, and drops
+// the ones that expired meanwhile.
+func (s *server) saveHistory(h *historyImport) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	h.ID = hex.EncodeToString(b)
+	h.ExpiresAt = now.Add(historyLifetime)
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	for id, other := range s.histories {
+		if now.After(other.ExpiresAt) {
+			delete(s.histories, id)
+		}
+	}
+	s.histories[h.ID] = h
+	return nil
+}
+
+// loadHistory returns the history waiting to be confirmed, or nil if there is
+// none or it expired.
+func (s *server) loadHistory(id string) *historyImport {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	h := s.histories[id]
+	if h == nil || time.Now().After(h.ExpiresAt) {
+		return nil
+	}
+	return h
+}
+
+// takeHistory returns the history to import, like loadHistory, and forgets it.
+func (s *server) takeHistory(id string) *historyImport {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	h := s.histories[id]
+	delete(s.histories, id)
+	if h == nil || time.Now().After(h.ExpiresAt) {
+		return nil
+	}
+	return h
+}
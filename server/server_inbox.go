@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// assignUnknownScans adds the tag to the album, and logs the plays of its
+// unknown scans at the time of the scans, and scrobbles them.
+func (s *server) assignUnknownScans(ctx context.Context, tag string, album *Album) ([]*Log, error) {
+	logs, err := s.db.AssignUnknownScans(ctx, tag, album)
+	if err != nil {
+		return nil, err
+	}
+	s.scrobbleAssignedScans(ctx, tag, album, logs)
+	return logs, nil
+}
+
+// scrobbleAssignedScans scrobbles the plays logged for the unknown scans of the
+// tag once they are assigned to the album.
+func (s *server) scrobbleAssignedScans(ctx context.Context, tag string, album *Album, logs []*Log) {
+	for _, log := range logs {
+		slog.Info("assigned unknown scan", "tag", tag, "album", album.String(), "log", log.ID)
+
+		err := s.queueScrobbles(ctx, log, album)
+		if err != nil {
+			slog.Error("could not queue scrobbles", "error", err)
+		}
+	}
+}
+
+// inboxCount returns the number of unknown scans waiting in the inbox, for the
+// navigation bar. Errors are only logged, as they should not break the page.
+func (s *server) inboxCount(ctx context.Context) int64 {
+	count, err := s.db.CountUnknownScans(ctx)
+	if err != nil {
+		slog.Error("could not count unknown scans", "error", err)
+	}
+	return count
+}
+
+func (s *server) getInbox(w http.ResponseWriter, r *http.Request) {
+	total, err := s.db.CountUnknownScans(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := newPagination(r, total, func(pg int) string {
+		return fmt.Sprintf("%s/inbox?page=%d", s.basePath, pg)
+	})
+
+	scans, err := s.db.GetUnknownScans(r.Context(), (p.Page-1)*pageSize, pageSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "inbox.html", map[string]interface{}{
+		"Title":      "Inbox",
+		"Scans":      scans,
+		"Total":      total,
+		"Pagination": p,
+	})
+}
+
+// getInboxScan shows the unknown scan, with the albums matching the search to
+// assign it to.
+func (s *server) getInboxScan(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	scan, err := s.db.GetUnknownScan(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	count, err := s.db.CountUnknownScansOfTag(r.Context(), scan.Tag)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	filter := parseAlbumFilter(r)
+	var albums []*Album
+	if filter.Search != "" {
+		albums, err = s.db.GetAlbums(r.Context(), filter, "name", "asc", 0, pageSize)
+		if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "inbox-scan.html", map[string]interface{}{
+		"Title":  "Unknown Scan",
+		"Scan":   scan,
+		"Others": count - 1,
+		"Filter": filter,
+		"Albums": albums,
+	})
+}
+
+// postInboxScan assigns the unknown scan to the album of the form, along with
+// the other scans of its tag.
+func (s *server) postInboxScan(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	scan, err := s.db.GetUnknownScan(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	albumID, err := strconv.ParseUint(strings.TrimSpace(r.FormValue("album_id")), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid album: %w", err))
+		return
+	}
+
+	album, err := s.db.GetAlbum(r.Context(), albumID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("album does not exist"))
+		return
+	} else if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = s.assignUnknownScans(r.Context(), scan.Tag, album)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/inbox", http.StatusSeeOther)
+}
+
+// postDismissInboxScan removes the unknown scan from the inbox without logging
+// it, for example for tags scanned by mistake.
+func (s *server) postDismissInboxScan(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.db.DeleteUnknownScan(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/inbox", http.StatusSeeOther)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnknownScansInbox(t *testing.T) {
+	s := newTestServer(t, config{apiToken: testApiToken, dedupWindow: time.Minute})
+	ctx := context.Background()
+
+	// A scan of the tag from an hour ago is still in the inbox.
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_, created, err := s.db.CreateUnknownScan(ctx, "04A1B2C3", nil, s.dedupWindow, earlier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("first scan was not created")
+	}
+
+	// Scans repeated within the deduplication window share an entry, and are
+	// only notified once.
+	for i := 0; i < 3; i++ {
+		w := serveApi(s, http.MethodPost, "/api/tag", "04A1B2C3")
+		var res apiTagResponse
+		err = json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || res.Status != tagStatusUnknown {
+			t.Fatalf("scan %d: status %d %q, want %d %q", i+1, w.Code, res.Status, http.StatusOK, tagStatusUnknown)
+		}
+	}
+	if n := len(s.notifications); n != 1 {
+		t.Errorf("%d notifications queued, want 1", n)
+	}
+
+	scans, err := s.db.GetUnknownScans(ctx, 0, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scans) != 2 || scans[0].Scans != 3 || scans[1].Scans != 1 {
+		t.Fatalf("inbox has %d entries, want the latest one scanned 3 times and the earlier one once", len(scans))
+	}
+
+	// Assigning one scan logs the plays of both.
+	album := &Album{Name: "Discovery", Artist: "Daft Punk"}
+	err = s.db.CreateAlbum(ctx, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := login(t, s)
+	w := serve(s, http.MethodPost, fmt.Sprintf("/inbox/%d", scans[0].ID), url.Values{
+		csrfFormField: {csrfTokenFor(s, cookies)},
+		"album_id":    {strconv.FormatUint(album.ID, 10)},
+	}, cookies)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("assign status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+
+	count, err := s.db.CountUnknownScans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d scans left in the inbox, want none", count)
+	}
+	assertAlbumTags(t, s, album.ID, "04A1B2C3")
+
+	logs, err := s.db.GetLogs(ctx, LogFilter{AlbumID: album.ID}, "asc", 0, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || !logs[0].Time.Equal(earlier) || !logs[1].Time.Equal(scans[0].Time) {
+		t.Errorf("album has %d logs, want one at %s and one at %s", len(logs), earlier, scans[0].Time)
+	}
+}
@@ -1,26 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
+	"strings"
 	"time"
 
-	"github.com/go-chi/jwtauth/v5"
-	"github.com/lestrrat-go/jwx/v3/jwt"
 	"golang.org/x/crypto/bcrypt"
-)
-
-const (
-	sessionSubject string = "Vinyl Scanner Session"
+	"gorm.io/gorm"
 )
 
 func (s *server) loginGet(w http.ResponseWriter, r *http.Request) {
 	if s.isLoggedIn(r) {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, s.safeRedirect(r.URL.Query().Get("redirect")), http.StatusSeeOther)
 		return
 	}
 
-	s.renderTemplate(w, http.StatusOK, "login.html", map[string]any{
+	s.renderTemplate(w, r, http.StatusOK, "login.html", map[string]any{
 		"Title": "Login",
 	})
 }
@@ -28,98 +29,202 @@ func (s *server) loginGet(w http.ResponseWriter, r *http.Request) {
 func (s *server) loginPost(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		s.renderTemplate(w, http.StatusBadRequest, "login.html", map[string]any{
+		s.renderTemplate(w, r, http.StatusBadRequest, "login.html", map[string]any{
 			"Title": "Login",
 			"Error": err.Error(),
 		})
 		return
 	}
 
+	// Guessing passwords is slowed down both by client and by username, so that
+	// neither many usernames from one client nor one username from many
+	// clients can be tried quickly.
 	username := r.FormValue("username")
-	password := r.FormValue("password")
-	correctPassword := bcrypt.CompareHashAndPassword([]byte(s.password), []byte(password)) == nil
-
-	if username != s.username || !correctPassword {
-		s.renderTemplate(w, http.StatusUnauthorized, "login.html", map[string]any{
+	keys := []string{loginIPKey(s.clientIP(r)), loginUserKey(username)}
+	if wait := s.attempts.begin(time.Now(), keys...); wait > 0 {
+		retryAfter(w, wait)
+		s.renderTemplate(w, r, http.StatusTooManyRequests, "login.html", map[string]any{
 			"Title": "Login",
-			"Error": "Invalid credentials.",
+			"Error": fmt.Sprintf("Too many failed attempts, try again in %s.", wait),
 		})
 		return
 	}
 
-	expiration := time.Now().Add(time.Hour * 24 * 7)
-
-	_, signed, err := s.jwtAuth.Encode(map[string]interface{}{
-		jwt.SubjectKey:    sessionSubject,
-		jwt.IssuedAtKey:   time.Now().Unix(),
-		jwt.ExpirationKey: expiration,
-	})
+	user, err := s.authenticateUser(r.Context(), username, r.FormValue("password"))
 	if err != nil {
-		s.renderTemplate(w, http.StatusInternalServerError, "login.html", map[string]any{
+		s.attempts.release(keys...)
+		s.renderTemplate(w, r, http.StatusInternalServerError, "login.html", map[string]any{
 			"Title": "Login",
 			"Error": err.Error(),
 		})
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     "jwt",
-		Value:    string(signed),
-		Expires:  expiration,
-		Secure:   r.URL.Scheme == "https",
-		HttpOnly: true,
-		Path:     "/",
-		SameSite: http.SameSiteLaxMode,
+	if user == nil {
+		s.failAttempt(keys...)
+		s.renderTemplate(w, r, http.StatusUnauthorized, "login.html", map[string]any{
+			"Title": "Login",
+			"Error": "Invalid credentials.",
+		})
+		return
 	}
 
-	http.SetCookie(w, cookie)
+	s.attempts.reset(keys...)
 
-	redirect := r.URL.Query().Get("redirect")
-	if redirect == "" {
-		redirect = "/"
+	err = s.startSession(w, r, user)
+	if err != nil {
+		s.renderTemplate(w, r, http.StatusInternalServerError, "login.html", map[string]any{
+			"Title": "Login",
+			"Error": err.Error(),
+		})
+		return
 	}
 
-	http.Redirect(w, r, redirect, http.StatusSeeOther)
+	http.Redirect(w, r, s.safeRedirect(r.URL.Query().Get("redirect")), http.StatusSeeOther)
 }
 
 func (s *server) logoutGet(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "jwt",
-		Value:    "",
-		MaxAge:   -1,
-		Secure:   r.URL.Scheme == "https",
-		Path:     "/",
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
-	if redirect := r.URL.Query().Get("redirect"); redirect != "" {
-		http.Redirect(w, r, redirect, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	if session, _ := s.currentSession(r); session != nil {
+		err := s.db.DeleteSession(r.Context(), session.UserID, session.ID)
+		if err != nil {
+			slog.Error("could not delete session", "error", err)
+		}
 	}
+
+	s.clearSessionCookie(w, r)
+	http.Redirect(w, r, s.safeRedirect(r.URL.Query().Get("redirect")), http.StatusSeeOther)
 }
 
+// mustLoggedIn only lets through the requests of logged in users, which are
+// then available with userFromContext. Their session is renewed as they use
+// it.
 func (s *server) mustLoggedIn(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !s.isLoggedIn(r) {
-			newPath := "/login?redirect=" + url.QueryEscape(r.URL.String())
-			http.Redirect(w, r, newPath, http.StatusSeeOther)
+		session, user := s.currentSession(r)
+		if user == nil {
+			s.redirectToLogin(w, r)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		s.renewSession(w, r, session)
+
+		ctx := context.WithValue(r.Context(), userContextKey{}, user)
+		ctx = context.WithValue(ctx, sessionContextKey{}, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// mustRole only lets through the users with the given role, or one above it.
+// It must be used after mustLoggedIn.
+func (s *server) mustRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !userFromContext(r.Context()).HasRole(role) {
+				s.renderError(w, r, http.StatusForbidden, fmt.Errorf("this page needs the %s role", role))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// redirectToLogin sends the user to the login page, which brings them back
+// once logged in. Only the pages that can be requested again are come back
+// to, which are the ones requested with GET. The requested URL already has
+// the path of the base URL.
+func (s *server) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	login := s.basePath + "/login"
+	if r.Method == http.MethodGet {
+		login += "?redirect=" + url.QueryEscape(r.URL.RequestURI())
+	}
+	http.Redirect(w, r, login, http.StatusSeeOther)
+}
+
+// safeRedirect returns the target if it is a page of the dashboard, or the
+// home page otherwise, so that links to the login and logout pages cannot send
+// users to other sites. Only paths under the base URL are allowed, without the
+// forms that browsers could take for another host once decoded or cleaned up.
+func (s *server) safeRedirect(target string) string {
+	home := s.basePath + "/"
+
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || hasUnsafeRedirectChars(target) {
+		return home
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return home
+	}
+
+	if strings.HasPrefix(u.Path, "//") || hasUnsafeRedirectChars(u.Path) {
+		return home
+	}
+
+	clean := path.Clean(u.Path)
+	if s.basePath != "" && clean != s.basePath && !strings.HasPrefix(clean, s.basePath+"/") {
+		return home
+	}
+
+	return (&url.URL{Path: clean, RawQuery: u.RawQuery}).String()
+}
+
+// hasUnsafeRedirectChars returns whether the target has backslashes, which
+// browsers take as slashes, or control characters, which they drop.
+func hasUnsafeRedirectChars(target string) bool {
+	return strings.ContainsFunc(target, func(r rune) bool {
+		return r == '\\' || r < ' ' || r == 0x7f
 	})
 }
 
 func (s *server) isLoggedIn(r *http.Request) bool {
-	token, _, err := jwtauth.FromContext(r.Context())
-	if err != nil || token == nil {
-		return false
+	_, user := s.currentSession(r)
+	return user != nil
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the logged in user, or nil if there is none.
+func userFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey{}).(*User)
+	return user
+}
+
+// configUser returns the admin from the configuration, if any. It is told
+// apart from the users in the database by its zero ID.
+func (s *server) configUser() *User {
+	if s.username == "" {
+		return nil
+	}
+	return &User{Username: s.username, Role: roleAdmin}
+}
+
+// authenticateUser returns the user with the given credentials, or nil if they
+// are not valid. The admin from the configuration takes precedence over the
+// users in the database.
+func (s *server) authenticateUser(ctx context.Context, username, password string) (*User, error) {
+	if user := s.configUser(); user != nil && username == user.Username {
+		if bcrypt.CompareHashAndPassword([]byte(s.password), []byte(password)) != nil {
+			return nil, nil
+		}
+		return user, nil
 	}
 
-	if subject, _ := token.Subject(); subject != sessionSubject {
-		return false
+	user, err := s.db.GetUserByUsername(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Take as long as if the user existed, so that usernames cannot be
+		// guessed from the response time.
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	return true
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
 }
+
+// dummyPasswordHash is compared against when the user does not exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
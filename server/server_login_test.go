@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSafeRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		basePath string
+		target   string
+		want     string
+	}{
+		{"", "", "/"},
+		{"", "/", "/"},
+		{"", "/logs", "/logs"},
+		{"", "/logs?album=1&order=asc", "/logs?album=1&order=asc"},
+		{"", "/albums/../logs", "/logs"},
+		{"", "//evil.example", "/"},
+		{"", "///evil.example", "/"},
+		{"", `/\evil.example`, "/"},
+		{"", `\/evil.example`, "/"},
+		{"", "/%2F%2Fevil.example", "/"},
+		{"", "/%5Cevil.example", "/"},
+		{"", "%2F%2Fevil", "/"},
+		{"", "https://evil.example", "/"},
+		{"", "https:/evil.example", "/"},
+		{"", "javascript:alert(1)", "/"},
+		{"", "/\t/evil", "/"},
+		{"", "/%09/evil", "/"},
+		{"", "/\n/evil", "/"},
+		{"", "evil.example", "/"},
+
+		{"/vinyl", "/vinyl", "/vinyl"},
+		{"/vinyl", "/vinyl/", "/vinyl"},
+		{"/vinyl", "/vinyl/logs?album=1", "/vinyl/logs?album=1"},
+		{"/vinyl", "/vinyl/albums/../logs", "/vinyl/logs"},
+		{"/vinyl", "/", "/vinyl/"},
+		{"/vinyl", "/logs", "/vinyl/"},
+		{"/vinyl", "//evil.example", "/vinyl/"},
+		{"/vinyl", "//evil.example/vinyl/logs", "/vinyl/"},
+		{"/vinyl", `/\evil.example`, "/vinyl/"},
+		{"/vinyl", "/vinyl/../../evil", "/vinyl/"},
+		{"/vinyl", "/vinyl/%2e%2e/%2e%2e/evil", "/vinyl/"},
+		{"/vinyl", "/vinylx/logs", "/vinyl/"},
+		{"/vinyl", "/vinylx", "/vinyl/"},
+		{"/vinyl", "https://evil.example/vinyl/logs", "/vinyl/"},
+	} {
+		s := &server{basePath: tc.basePath}
+		if got := s.safeRedirect(tc.target); got != tc.want {
+			t.Errorf("safeRedirect(%q) with base path %q = %q, want %q", tc.target, tc.basePath, got, tc.want)
+		}
+	}
+}
+
+func TestLoginRedirectRoundTrip(t *testing.T) {
+	s := newTestServer(t, config{baseURL: "https://example.com/vinyl/"})
+
+	const page = "/vinyl/logs?album=3&order=asc&q=a%26b"
+	w := serve(s, http.MethodGet, page, nil, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("GET %s status = %d, want %d", page, w.Code, http.StatusSeeOther)
+	}
+	loginURL := w.Header().Get("Location")
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/vinyl/login" || u.Query().Get("redirect") != page {
+		t.Fatalf("redirected to %s, want the login page back to %s", loginURL, page)
+	}
+
+	w = serve(s, http.MethodGet, loginURL, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s status = %d, want %d", loginURL, w.Code, http.StatusOK)
+	}
+
+	// The login form is posted back to its own URL, redirect included.
+	w = serve(s, http.MethodPost, loginURL, url.Values{
+		"username": {testUsername},
+		"password": {testPassword},
+	}, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %s status = %d, want %d", loginURL, w.Code, http.StatusSeeOther)
+	}
+	if got := w.Header().Get("Location"); got != page {
+		t.Errorf("logged in and redirected to %s, want %s", got, page)
+	}
+
+	w = serve(s, http.MethodGet, page, nil, w.Result().Cookies())
+	if w.Code != http.StatusOK {
+		t.Errorf("GET %s after login status = %d, want %d", page, w.Code, http.StatusOK)
+	}
+}
@@ -1,26 +1,110 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// parseLogFilter reads the filter from the query parameters. Invalid values
+// are ignored.
+func parseLogFilter(r *http.Request) LogFilter {
+	q := r.URL.Query()
+	deviceID, _ := strconv.ParseUint(q.Get("device"), 10, 64)
+	albumID, _ := strconv.ParseUint(q.Get("album"), 10, 64)
+	from, _ := time.ParseInLocation(time.DateOnly, q.Get("from"), time.Local)
+	to, _ := time.ParseInLocation(time.DateOnly, q.Get("to"), time.Local)
+	return LogFilter{
+		DeviceID: deviceID,
+		AlbumID:  albumID,
+		Artist:   strings.TrimSpace(q.Get("artist")),
+		From:     from,
+		To:       to,
+	}
+}
+
+// FromDate and ToDate return the dates of the filter as set in the query
+// parameters, or empty if not set.
+func (f LogFilter) FromDate() string {
+	return formatDate(f.From)
+}
+
+func (f LogFilter) ToDate() string {
+	return formatDate(f.To)
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.DateOnly)
+}
+
+// query returns the filter as URL query parameters, ending with an ampersand
+// so that more parameters can be appended.
+func (f LogFilter) query() string {
+	values := url.Values{}
+	if f.DeviceID != 0 {
+		values.Set("device", strconv.FormatUint(f.DeviceID, 10))
+	}
+	if f.AlbumID != 0 {
+		values.Set("album", strconv.FormatUint(f.AlbumID, 10))
+	}
+	if f.Artist != "" {
+		values.Set("artist", f.Artist)
+	}
+	if !f.From.IsZero() {
+		values.Set("from", f.FromDate())
+	}
+	if !f.To.IsZero() {
+		values.Set("to", f.ToDate())
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+	return values.Encode() + "&"
+}
+
 func (s *server) getLogs(w http.ResponseWriter, r *http.Request) {
 	order := parseOrder(r, "desc")
+	filter := parseLogFilter(r)
 
-	total, err := s.db.CountLogs(r.Context())
+	total, err := s.db.CountLogs(r.Context(), filter)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
 	p := newPagination(r, total, func(pg int) string {
-		return fmt.Sprintf("/logs?order=%s&page=%d", order, pg)
+		return fmt.Sprintf("%s/logs?%sorder=%s&page=%d", s.basePath, filter.query(), order, pg)
 	})
 
-	logs, err := s.db.GetLogs(r.Context(), order, (p.Page-1)*pageSize, pageSize)
+	logs, err := s.db.GetLogs(r.Context(), filter, order, (p.Page-1)*pageSize, pageSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	devices, err := s.db.GetDevices(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	albums, err := s.db.GetAlbums(r.Context(), AlbumFilter{}, "name", "asc", 0, -1)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	artists, err := s.db.GetArtists(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -29,12 +113,17 @@ func (s *server) getLogs(w http.ResponseWriter, r *http.Request) {
 		toggleOrder = "desc"
 	}
 
-	s.renderTemplate(w, http.StatusOK, "logs.html", map[string]interface{}{
+	s.renderTemplate(w, r, http.StatusOK, "logs.html", map[string]interface{}{
 		"Title":       "Logs",
 		"Logs":        logs,
 		"Total":       total,
 		"Order":       order,
-		"SortTimeURL": fmt.Sprintf("/logs?order=%s&page=1", toggleOrder),
+		"Filter":      filter,
+		"FilterQuery": filter.query(),
+		"Devices":     devices,
+		"Albums":      albums,
+		"Artists":     artists,
+		"SortTimeURL": fmt.Sprintf("%s/logs?%sorder=%s&page=1", s.basePath, filter.query(), toggleOrder),
 		"Pagination":  p,
 	})
 }
@@ -42,17 +131,17 @@ func (s *server) getLogs(w http.ResponseWriter, r *http.Request) {
 func (s *server) getDeleteLog(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	log, err := s.db.GetLog(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	s.renderTemplate(w, http.StatusOK, "log-delete.html", map[string]interface{}{
+	s.renderTemplate(w, r, http.StatusOK, "log-delete.html", map[string]interface{}{
 		"Title": "Delete Log Entry",
 		"Log":   log,
 	})
@@ -61,15 +150,51 @@ func (s *server) getDeleteLog(w http.ResponseWriter, r *http.Request) {
 func (s *server) postDeleteLog(w http.ResponseWriter, r *http.Request) {
 	id, err := extractID(r)
 	if err != nil {
-		s.renderError(w, http.StatusBadRequest, err)
+		s.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	err = s.db.DeleteLog(r.Context(), id)
+	err = s.deleteLog(r.Context(), id)
 	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err)
+		s.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.Redirect(w, r, "/logs", http.StatusSeeOther)
+	http.Redirect(w, r, s.basePath+"/logs", http.StatusSeeOther)
+}
+
+// deleteLog deletes the log and lets the live pages know.
+func (s *server) deleteLog(ctx context.Context, id uint64) error {
+	err := s.db.DeleteLog(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.publishLogDeleted(id)
+	return nil
+}
+
+func (s *server) getSuppressedScans(w http.ResponseWriter, r *http.Request) {
+	total, err := s.db.CountSuppressedScans(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := newPagination(r, total, func(pg int) string {
+		return fmt.Sprintf("%s/logs/suppressed?page=%d", s.basePath, pg)
+	})
+
+	scans, err := s.db.GetSuppressedScans(r.Context(), (p.Page-1)*pageSize, pageSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "logs-suppressed.html", map[string]interface{}{
+		"Title":      "Suppressed Scans",
+		"Scans":      scans,
+		"Total":      total,
+		"Pagination": p,
+	})
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// enrichInterval is the time waited between albums when enriching all of them,
+// to stay within the rate limits of the metadata providers.
+const enrichInterval = 2 * time.Second
+
+var errUnknownProvider = errors.New("unknown metadata provider")
+
+type lookupResult struct {
+	Provider string
+	Release  *Release
+	URL      string
+}
+
+// getAlbumLookup searches the metadata providers for the album being created
+// or updated, and links back to its form with the chosen release.
+func (s *server) getAlbumLookup(w http.ResponseWriter, r *http.Request) {
+	if len(s.metadata) == 0 {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("no metadata provider is configured"))
+		return
+	}
+
+	q := r.URL.Query()
+	query := MetadataQuery{
+		Artist:  strings.TrimSpace(q.Get("artist")),
+		Title:   strings.TrimSpace(q.Get("name")),
+		Barcode: strings.TrimSpace(q.Get("barcode")),
+	}
+
+	if query.Barcode == "" && (query.Artist == "" || query.Title == "") {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("name and artist, or barcode, are needed to look up an album"))
+		return
+	}
+
+	// Go back to the form the lookup was started from.
+	formURL := s.basePath + "/albums/new"
+	if id := q.Get("id"); id != "" {
+		_, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		formURL = s.basePath + "/albums/" + id
+	}
+
+	params := url.Values{}
+	params.Set("name", query.Title)
+	params.Set("artist", query.Artist)
+	params.Set("barcode", query.Barcode)
+	params.Set("tags", q.Get("tags"))
+	params.Set("log", q.Get("log"))
+	params.Set("inbox", q.Get("inbox"))
+
+	var results []*lookupResult
+	var errs []string
+	for _, p := range s.metadata {
+		releases, err := p.Search(r.Context(), query)
+		if err != nil {
+			slog.Warn("could not search album metadata", "provider", p.Name(), "error", err)
+			errs = append(errs, fmt.Sprintf("%s: %s", p.Name(), err))
+			continue
+		}
+
+		for _, release := range releases {
+			params.Set("provider", p.Name())
+			params.Set("release", release.ID)
+			results = append(results, &lookupResult{
+				Provider: p.Name(),
+				Release:  release,
+				URL:      formURL + "?" + params.Encode(),
+			})
+		}
+	}
+
+	params.Del("provider")
+	params.Del("release")
+
+	s.renderTemplate(w, r, http.StatusOK, "album-lookup.html", map[string]interface{}{
+		"Title":   "Look Up Album",
+		"Query":   query,
+		"Results": results,
+		"Errors":  errs,
+		"BackURL": formURL + "?" + params.Encode(),
+	})
+}
+
+// applyLookup fills the album with the release chosen in the lookup page, if
+// any.
+func (s *server) applyLookup(r *http.Request, album *Album) error {
+	name, id := r.URL.Query().Get("provider"), r.URL.Query().Get("release")
+	if name == "" || id == "" {
+		return nil
+	}
+
+	p := s.metadataProvider(name)
+	if p == nil {
+		return fmt.Errorf("%w: %s", errUnknownProvider, name)
+	}
+
+	release, err := p.Release(r.Context(), id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Name(), err)
+	}
+
+	applyRelease(album, release, true)
+	return nil
+}
+
+func (s *server) renderLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUnknownProvider) {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	s.renderError(w, r, http.StatusBadGateway, err)
+}
+
+// enrichStatus is the progress of the latest job enriching all albums.
+type enrichStatus struct {
+	Running  bool
+	Total    int
+	Done     int
+	Enriched int
+	Failed   int
+}
+
+func (s *server) getEnrichStatus() enrichStatus {
+	s.enrichMu.Lock()
+	defer s.enrichMu.Unlock()
+	return s.enrich
+}
+
+func (s *server) updateEnrichStatus(update func(status *enrichStatus)) {
+	s.enrichMu.Lock()
+	defer s.enrichMu.Unlock()
+	update(&s.enrich)
+}
+
+func (s *server) postEnrichAlbums(w http.ResponseWriter, r *http.Request) {
+	if len(s.metadata) == 0 {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("no metadata provider is configured"))
+		return
+	}
+
+	// If a job is already queued, it will pick up the albums anyway.
+	select {
+	case s.enrichRequests <- struct{}{}:
+	default:
+	}
+
+	http.Redirect(w, r, s.basePath+"/albums", http.StatusSeeOther)
+}
+
+// watchEnrichRequests enriches all albums whenever requested, until the
+// context is cancelled.
+func (s *server) watchEnrichRequests(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.enrichRequests:
+			s.enrichAlbums(ctx)
+		}
+	}
+}
+
+// enrichAlbums fills the missing metadata of the albums that were not enriched
+// yet. Albums for which a provider failed are retried the next time.
+func (s *server) enrichAlbums(ctx context.Context) {
+	albums, err := s.db.GetAlbumsToEnrich(ctx)
+	if err != nil {
+		slog.Error("could not load albums to enrich", "error", err)
+		return
+	}
+
+	s.updateEnrichStatus(func(status *enrichStatus) {
+		*status = enrichStatus{Running: true, Total: len(albums)}
+	})
+	defer s.updateEnrichStatus(func(status *enrichStatus) {
+		status.Running = false
+	})
+
+	for i, album := range albums {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(enrichInterval):
+			}
+		}
+
+		found, err := s.enrichAlbum(ctx, album)
+		if err != nil {
+			slog.Warn("could not enrich album", "album", album.String(), "error", err)
+		}
+
+		s.updateEnrichStatus(func(status *enrichStatus) {
+			status.Done++
+			if err != nil {
+				status.Failed++
+			} else if found {
+				status.Enriched++
+			}
+		})
+	}
+
+	status := s.getEnrichStatus()
+	slog.Info("enriched albums", "total", status.Total, "enriched", status.Enriched, "failed", status.Failed)
+}
+
+func (s *server) enrichAlbum(ctx context.Context, album *Album) (bool, error) {
+	release, err := s.findRelease(ctx, album)
+	if err != nil {
+		return false, err
+	}
+
+	if release != nil {
+		applyRelease(album, release, false)
+	}
+
+	if album.Cover == "" && album.MBID != "" && s.coverArtURL != "" {
+		data, err := s.fetchCover(ctx, album.MBID)
+		if err != nil && !errors.Is(err, errNoCover) {
+			return false, fmt.Errorf("could not fetch cover: %w", err)
+		} else if err == nil {
+			album.Cover, err = s.saveCover(data)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	now := time.Now()
+	album.EnrichedAt = &now
+	return release != nil, s.db.UpdateAlbumMetadata(ctx, album)
+}
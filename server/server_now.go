@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// mustLiveAccess only lets through the requests to the live pages if they are
+// public, come from a logged in user, or have an API token with the read
+// scope. The token can also be given in the token query parameter, as browsers
+// cannot set headers on EventSource connections. Other requests are passed to
+// denied.
+func (s *server) mustLiveAccess(denied http.HandlerFunc) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.nowPublic || s.isLoggedIn(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("Authorization") == "" && !r.URL.Query().Has("token") {
+				denied(w, r)
+				return
+			}
+
+			key := apiIPKey(s.clientIP(r))
+			if s.attempts.begin(time.Now(), key) > 0 {
+				denied(w, r)
+				return
+			}
+
+			token, err := s.authenticateApiToken(r)
+			if err == nil && token == nil {
+				if value := r.URL.Query().Get("token"); value != "" {
+					token, err = s.findApiToken(r.Context(), value)
+				}
+			}
+			if err != nil {
+				slog.Error("could not authenticate api token", "error", err)
+				s.attempts.release(key)
+			} else if token == nil {
+				s.failAttempt(key)
+			} else {
+				s.attempts.release(key)
+			}
+
+			if token == nil || !token.HasScope(scopeRead) {
+				denied(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func unauthorizedApiEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusUnauthorized, errors.New("log in or use an api token with the read scope"))
+}
+
+// getNow shows what is on the shelves, and keeps it up to date with the live
+// events.
+func (s *server) getNow(w http.ResponseWriter, r *http.Request) {
+	plays, err := s.db.GetOpenPlays(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var latest *Log
+	if len(plays) == 0 {
+		latest, err = s.db.GetLatestLog(r.Context())
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			latest = nil
+		} else if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	eventsURL := s.basePath + "/api/v1/events"
+	if token := r.URL.Query().Get("token"); token != "" {
+		eventsURL += "?token=" + url.QueryEscape(token)
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "now.html", map[string]interface{}{
+		"Title":     "Now Playing",
+		"Plays":     plays,
+		"Latest":    latest,
+		"EventsURL": eventsURL,
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// startPlay ends whatever was on the device's shelf and starts a new play for
+// the album, scanned with the tag. If the album was the last one on the shelf, and it was seen within
+// the deduplication window, the scan is recorded as suppressed and the previous
+// play is resumed instead. In that case, duplicate is true. The device is nil
+// for scans that cannot be attributed to a device. Either way, the live pages
+// are told that the album is on the shelf.
+func (s *server) startPlay(ctx context.Context, album *Album, tag string, device *Device) (log *Log, duplicate bool, err error) {
+	s.playsMu.Lock()
+	defer s.playsMu.Unlock()
+
+	now := time.Now()
+	if s.dedupWindow > 0 {
+		log, err = s.resumePlay(ctx, album, tag, device, now)
+		if err == nil {
+			duplicate = true
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, err
+		}
+	}
+
+	if !duplicate {
+		err = s.endOpenPlay(ctx, device, now)
+		if err != nil {
+			return nil, false, err
+		}
+
+		log, err = s.db.StartPlay(ctx, album, device, now)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	log.Album = *album
+	log.Device = device
+	s.publishScan(tag, log)
+	return log, duplicate, nil
+}
+
+// resumePlay resumes the latest play if it belongs to the album and was seen
+// within the deduplication window. It returns gorm.ErrRecordNotFound if there
+// is no such play.
+func (s *server) resumePlay(ctx context.Context, album *Album, tag string, device *Device, now time.Time) (*Log, error) {
+	log, err := s.getLatestPlay(ctx, device, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if log.AlbumID != album.ID || log.LastActivity().Before(now.Add(-s.dedupWindow)) {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	slog.Info("suppressing duplicate scan", "album", album.String(), "log", log.ID)
+
+	err = s.db.CreateSuppressedScan(ctx, log, tag, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plays created without tracking the removal, such as the ones logged
+	// from the dashboard, stay as they are.
+	if log.LastSeen == nil {
+		return log, nil
+	}
+
+	return log, s.db.ResumePlay(ctx, log, now)
+}
+
+// stopPlay ends the open play of the device, for example because an unknown
+// tag was placed on the shelf.
+func (s *server) stopPlay(ctx context.Context, device *Device) error {
+	s.playsMu.Lock()
+	defer s.playsMu.Unlock()
+
+	return s.endOpenPlay(ctx, device, time.Now())
+}
+
+// touchPlay marks the open play for the given tag as still being on the shelf.
+// It returns gorm.ErrRecordNotFound if the tag does not have an open play.
+func (s *server) touchPlay(ctx context.Context, tag string, device *Device) error {
+	s.playsMu.Lock()
+	defer s.playsMu.Unlock()
+
+	now := time.Now()
+	log, err := s.getOpenPlay(ctx, device, now)
+	if err != nil {
+		return err
+	}
+
+	if !log.Album.HasTag(tag) {
+		return gorm.ErrRecordNotFound
+	}
+
+	return s.db.TouchPlay(ctx, log, now)
+}
+
+// removePlay ends the open play for the given tag, or whatever play is open
+// if the tag is empty. It returns gorm.ErrRecordNotFound if there is no such
+// open play.
+func (s *server) removePlay(ctx context.Context, tag string, device *Device) error {
+	s.playsMu.Lock()
+	defer s.playsMu.Unlock()
+
+	now := time.Now()
+	log, err := s.getOpenPlay(ctx, device, now)
+	if err != nil {
+		return err
+	}
+
+	if tag != "" && !log.Album.HasTag(tag) {
+		return gorm.ErrRecordNotFound
+	}
+
+	return s.endPlay(ctx, log, now)
+}
+
+// getOpenPlay returns the open play of the device after ending the ones that
+// went idle.
+func (s *server) getOpenPlay(ctx context.Context, device *Device, now time.Time) (*Log, error) {
+	err := s.endIdlePlays(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.GetOpenPlay(ctx, device)
+}
+
+// getLatestPlay returns the latest play of the device after ending the ones
+// that went idle.
+func (s *server) getLatestPlay(ctx context.Context, device *Device, now time.Time) (*Log, error) {
+	err := s.endIdlePlays(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.GetLatestPlay(ctx, device)
+}
+
+func (s *server) endIdlePlays(ctx context.Context, now time.Time) error {
+	if s.playIdleTimeout <= 0 {
+		return nil
+	}
+
+	return s.db.EndIdlePlays(ctx, now.Add(-s.playIdleTimeout))
+}
+
+func (s *server) endOpenPlay(ctx context.Context, device *Device, now time.Time) error {
+	log, err := s.getOpenPlay(ctx, device, now)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return s.endPlay(ctx, log, now)
+}
+
+// endPlay ends the play at the given time. Plays shorter than the minimum play
+// duration are discarded, as they are most likely accidental placements. Plays
+// ended due to inactivity are not discarded, since their end is only a guess.
+func (s *server) endPlay(ctx context.Context, log *Log, end time.Time) error {
+	err := s.db.EndPlay(ctx, log, end)
+	if err != nil {
+		return err
+	}
+
+	if log.Duration() < s.playMinDuration {
+		slog.Info("discarding short play", "album", log.Album.String(), "duration", log.Duration())
+		return s.deleteLog(ctx, log.ID)
+	}
+
+	return nil
+}
+
+// watchIdlePlays periodically ends the plays that were not seen for longer
+// than the idle timeout, until the context is cancelled.
+func (s *server) watchIdlePlays(ctx context.Context) {
+	if s.playIdleTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(s.playIdleTimeout, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.playsMu.Lock()
+			err := s.endIdlePlays(ctx, now)
+			s.playsMu.Unlock()
+			if err != nil {
+				slog.Error("could not end idle plays", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// getSessions lists where the user is logged in.
+func (s *server) getSessions(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+
+	sessions, err := s.db.GetUserSessions(r.Context(), user.ID, time.Now())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "sessions.html", map[string]interface{}{
+		"Title":    "Sessions",
+		"Sessions": sessions,
+		"Current":  sessionFromContext(r.Context()),
+	})
+}
+
+// postRevokeSession logs out one of the sessions of the user. Revoking the
+// current session is the same as logging out.
+func (s *server) postRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.db.DeleteSession(r.Context(), userFromContext(r.Context()).ID, id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if id == sessionFromContext(r.Context()).ID {
+		s.clearSessionCookie(w, r)
+		http.Redirect(w, r, s.basePath+"/login", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/sessions", http.StatusSeeOther)
+}
+
+// postRevokeSessions logs out everywhere, the current session included.
+func (s *server) postRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	err := s.db.DeleteUserSessions(r.Context(), userFromContext(r.Context()).ID, 0)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.clearSessionCookie(w, r)
+	http.Redirect(w, r, s.basePath+"/login", http.StatusSeeOther)
+}
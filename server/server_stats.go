@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const statsTopSize = 10
+
+type statsWindow struct {
+	Name  string
+	Label string
+	Days  int
+}
+
+var statsWindows = []statsWindow{
+	{Name: "week", Label: "Week", Days: 7},
+	{Name: "month", Label: "Month", Days: 30},
+	{Name: "year", Label: "Year", Days: 365},
+	{Name: "all", Label: "All Time"},
+}
+
+func parseStatsWindow(r *http.Request) statsWindow {
+	name := r.URL.Query().Get("window")
+	for _, w := range statsWindows {
+		if w.Name == name {
+			return w
+		}
+	}
+	return statsWindows[1]
+}
+
+func (w statsWindow) since(now time.Time) time.Time {
+	if w.Days == 0 {
+		return time.Time{}
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return day.AddDate(0, 0, -w.Days+1)
+}
+
+type heatmapCell struct {
+	Label   string
+	Plays   int64
+	Opacity float64
+}
+
+type heatmapRow struct {
+	Label string
+	Cells []heatmapCell
+}
+
+func heatmapOpacity(plays, maxPlays int64) float64 {
+	if plays == 0 || maxPlays == 0 {
+		return 0
+	}
+	return 0.15 + 0.85*float64(plays)/float64(maxPlays)
+}
+
+// newDayHeatmap lays out the daily plays as a calendar with one row per week,
+// starting on the Monday before from and ending on to.
+func newDayHeatmap(plays []*PeriodPlays, from, to time.Time) []heatmapRow {
+	counts := map[string]int64{}
+	var maxPlays int64
+	for _, p := range plays {
+		counts[p.Period] = p.Plays
+		maxPlays = max(maxPlays, p.Plays)
+	}
+
+	offset := (int(from.Weekday()) + 6) % 7
+	start := from.AddDate(0, 0, -offset)
+
+	var rows []heatmapRow
+	for week := start; !week.After(to); week = week.AddDate(0, 0, 7) {
+		row := heatmapRow{Label: week.Format("Jan 02")}
+		for i := range 7 {
+			day := week.AddDate(0, 0, i)
+			if day.Before(from) || day.After(to) {
+				row.Cells = append(row.Cells, heatmapCell{})
+				continue
+			}
+
+			key := day.Format(time.DateOnly)
+			row.Cells = append(row.Cells, heatmapCell{
+				Label:   key,
+				Plays:   counts[key],
+				Opacity: heatmapOpacity(counts[key], maxPlays),
+			})
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// newWeekdayHourHeatmap lays out the plays as a grid with one row per weekday,
+// starting on Monday, and one column per hour.
+func newWeekdayHourHeatmap(plays []*WeekdayHourPlays) []heatmapRow {
+	var counts [7][24]int64
+	var maxPlays int64
+	for _, p := range plays {
+		counts[p.Weekday][p.Hour] = p.Plays
+		maxPlays = max(maxPlays, p.Plays)
+	}
+
+	var rows []heatmapRow
+	for i := range 7 {
+		weekday := time.Weekday((i + 1) % 7)
+		row := heatmapRow{Label: weekday.String()[:3]}
+		for hour := range 24 {
+			row.Cells = append(row.Cells, heatmapCell{
+				Label:   fmt.Sprintf("%s %02d:00", weekday, hour),
+				Plays:   counts[weekday][hour],
+				Opacity: heatmapOpacity(counts[weekday][hour], maxPlays),
+			})
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+type streaks struct {
+	Current int
+	Longest int
+}
+
+// computeStreaks calculates the current and longest runs of consecutive days
+// with at least one play. The current streak is still alive if the last play
+// was either today or yesterday.
+func computeStreaks(plays []*PeriodPlays, today time.Time) streaks {
+	var (
+		s    streaks
+		run  int
+		prev time.Time
+	)
+
+	for _, p := range plays {
+		day, err := time.ParseInLocation(time.DateOnly, p.Period, today.Location())
+		if err != nil {
+			continue
+		}
+
+		if !prev.IsZero() && prev.AddDate(0, 0, 1).Equal(day) {
+			run++
+		} else {
+			run = 1
+		}
+		s.Longest = max(s.Longest, run)
+		prev = day
+	}
+
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+	if !prev.IsZero() && !prev.Before(today.AddDate(0, 0, -1)) {
+		s.Current = run
+	}
+
+	return s
+}
+
+func (s *server) getStats(w http.ResponseWriter, r *http.Request) {
+	window := parseStatsWindow(r)
+	now := time.Now()
+	since := window.since(now)
+
+	total, err := s.db.CountPlays(r.Context(), since)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	listeningTime, err := s.db.GetListeningTime(r.Context(), since)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	topAlbums, err := s.db.GetTopAlbums(r.Context(), since, statsTopSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	topArtists, err := s.db.GetTopArtists(r.Context(), since, statsTopSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	weekdayHourPlays, err := s.db.GetPlaysByWeekdayHour(r.Context(), since)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Daily plays are always fetched for all time, as they are also used to
+	// compute the streaks. There is at most one row per day.
+	dayPlays, err := s.db.GetPlaysByDay(r.Context(), time.Time{})
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The calendar shows at most one year, which is also what is shown when
+	// looking at all time.
+	from := statsWindows[2].since(now)
+	if !since.IsZero() {
+		from = since
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "stats.html", map[string]interface{}{
+		"Title":              "Statistics",
+		"Window":             window,
+		"Windows":            statsWindows,
+		"Total":              total,
+		"ListeningTime":      formatDuration(listeningTime),
+		"TopAlbums":          topAlbums,
+		"TopArtists":         topArtists,
+		"DayHeatmap":         newDayHeatmap(dayPlays, from, now),
+		"WeekdayHourHeatmap": newWeekdayHourHeatmap(weekdayHourPlays),
+		"Streaks":            computeStreaks(dayPlays, now),
+	})
+}
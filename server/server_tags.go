@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// tagAssignmentLifetime is how long an album waits for its tag to be scanned.
+const tagAssignmentLifetime = 10 * time.Minute
+
+// tagAssignment is the album that the next unknown tag scanned on a shelf is
+// stuck on.
+type tagAssignment struct {
+	AlbumID   uint64
+	ExpiresAt time.Time
+}
+
+// parseTags returns the tags separated by commas, without duplicates.
+func parseTags(str string) []string {
+	var tags []string
+	for _, tag := range splitList(str, ",") {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// getTagAssignment returns the album waiting for its tag, or nil if there is
+// none or it expired.
+func (s *server) getTagAssignment() *tagAssignment {
+	s.tagAssignmentMu.Lock()
+	defer s.tagAssignmentMu.Unlock()
+	if s.tagAssignment == nil || time.Now().After(s.tagAssignment.ExpiresAt) {
+		return nil
+	}
+	a := *s.tagAssignment
+	return &a
+}
+
+// assignTag sticks the unknown tag on the album waiting for its tag,
+// if any, and returns the album. It returns gorm.ErrRecordNotFound if no album
+// is waiting.
+func (s *server) assignTag(ctx context.Context, tag string) (*Album, error) {
+	s.tagAssignmentMu.Lock()
+	defer s.tagAssignmentMu.Unlock()
+
+	a := s.tagAssignment
+	if a == nil || time.Now().After(a.ExpiresAt) {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	album, err := s.db.GetAlbum(ctx, a.AlbumID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.AddAlbumTag(ctx, album, tag, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	s.tagAssignment = nil
+	slog.Info("assigned tag to album", "tag", tag, "album", album.String())
+	return album, nil
+}
+
+func (s *server) postAssignTag(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	album, err := s.db.GetAlbum(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.tagAssignmentMu.Lock()
+	s.tagAssignment = &tagAssignment{AlbumID: album.ID, ExpiresAt: time.Now().Add(tagAssignmentLifetime)}
+	s.tagAssignmentMu.Unlock()
+
+	http.Redirect(w, r, s.basePath+"/albums/"+strconv.FormatUint(album.ID, 10), http.StatusSeeOther)
+}
+
+func (s *server) postCancelAssignTag(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	s.tagAssignmentMu.Lock()
+	if s.tagAssignment != nil && s.tagAssignment.AlbumID == id {
+		s.tagAssignment = nil
+	}
+	s.tagAssignmentMu.Unlock()
+
+	http.Redirect(w, r, s.basePath+"/albums/"+strconv.FormatUint(id, 10), http.StatusSeeOther)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testUsername = "admin"
+	testPassword = "correct horse battery staple"
+)
+
+// newTestServer returns a server with its data in a temporary directory and
+// the config user admin, on top of the given config.
+func newTestServer(t *testing.T, cfg config) *server {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.dataDir = t.TempDir()
+	cfg.username = testUsername
+	cfg.password = base64.StdEncoding.EncodeToString(hash)
+	if cfg.sessionLifetime == 0 {
+		cfg.sessionLifetime = time.Hour
+	}
+	if cfg.loginMaxAttempts == 0 {
+		cfg.loginMaxAttempts = 5
+		cfg.loginBackoff = time.Second
+		cfg.loginLockout = time.Minute
+	}
+
+	s, err := newServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.db.Close()
+	})
+	return s
+}
+
+// serve handles the request with the given cookies, and a form body if any.
+func serve(s *server, method, target string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r := httptest.NewRequest(method, target, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// login logs in as the config user and returns the session cookies.
+func login(t *testing.T, s *server) []*http.Cookie {
+	t.Helper()
+
+	w := serve(s, http.MethodPost, s.basePath+"/login", url.Values{
+		"username": {testUsername},
+		"password": {testPassword},
+	}, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	return w.Result().Cookies()
+}
+
+// csrfTokenFor returns the CSRF token of the session with the given cookies.
+func csrfTokenFor(s *server, cookies []*http.Cookie) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return s.csrfToken(r)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+func (s *server) getTokens(w http.ResponseWriter, r *http.Request) {
+	s.renderTokens(w, r, http.StatusOK, "")
+}
+
+func (s *server) renderTokens(w http.ResponseWriter, r *http.Request, code int, newToken string) {
+	tokens, err := s.db.GetApiTokens(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	devices, err := s.db.GetDevices(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The tokens of the devices are managed on their page.
+	deviceTokens := map[uint64]*Device{}
+	for _, device := range devices {
+		deviceTokens[device.ApiTokenID] = device
+	}
+
+	s.renderTemplate(w, r, code, "tokens.html", map[string]interface{}{
+		"Title":    "API Tokens",
+		"Tokens":   tokens,
+		"Devices":  deviceTokens,
+		"Scopes":   allScopes,
+		"NewToken": newToken,
+	})
+}
+
+func (s *server) postNewToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	scopes := r.Form["scope"]
+
+	if name == "" || len(scopes) == 0 {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("name or scope is missing"))
+		return
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(allScopes, scope) {
+			s.renderError(w, r, http.StatusBadRequest, errors.New("invalid scope"))
+			return
+		}
+	}
+
+	value, err := generateApiToken()
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.db.CreateApiToken(r.Context(), &ApiToken{
+		Name:   name,
+		Prefix: value[:10],
+		Hash:   hashApiToken(value),
+		Scopes: strings.Join(scopes, ","),
+	})
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The token is only shown once, as only its hash is stored.
+	s.renderTokens(w, r, http.StatusCreated, value)
+}
+
+func (s *server) getRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := s.db.GetApiToken(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	code, err := s.checkRevokable(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "token-revoke.html", map[string]interface{}{
+		"Title": "Revoke API Token",
+		"Token": token,
+	})
+}
+
+func (s *server) postRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	code, err := s.checkRevokable(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+
+	err = s.db.DeleteApiToken(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/tokens", http.StatusSeeOther)
+}
+
+// checkRevokable refuses to revoke the token of a device, which would leave
+// the device without any. It is regenerated from the device page instead. On
+// error, it returns the status code to respond with.
+func (s *server) checkRevokable(ctx context.Context, id uint64) (int, error) {
+	device, err := s.db.GetDeviceByApiToken(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusConflict, fmt.Errorf("the token belongs to the device %s, regenerate it from the device page instead", device)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newTokenRegexp matches the token shown once after it is created.
+var newTokenRegexp = regexp.MustCompile(`<pre>([^<]+)</pre>`)
+
+// heartbeat sends a device heartbeat with the token and returns the status.
+func heartbeat(s *server, token string) int {
+	r := httptest.NewRequest(http.MethodPost, "/api/device/heartbeat", strings.NewReader(`{"firmware_version":"1.0"}`))
+	r.Header.Set("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestDeviceToken(t *testing.T) {
+	s := newTestServer(t, config{})
+	cookies := login(t, s)
+	csrf := url.Values{csrfFormField: {csrfTokenFor(s, cookies)}}
+	ctx := context.Background()
+
+	w := serve(s, http.MethodPost, "/devices", url.Values{
+		csrfFormField: {csrfTokenFor(s, cookies)},
+		"name":        {"Shelf"},
+	}, cookies)
+	m := newTokenRegexp.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusCreated || m == nil {
+		t.Fatalf("POST /devices status = %d without a token, want %d with one", w.Code, http.StatusCreated)
+	}
+	token := m[1]
+	if code := heartbeat(s, token); code != http.StatusOK {
+		t.Fatalf("heartbeat status = %d, want %d", code, http.StatusOK)
+	}
+
+	devices, err := s.db.GetDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := devices[0]
+
+	// The token of the device links to it instead of being revoked.
+	w = serve(s, http.MethodGet, "/tokens", nil, cookies)
+	body := w.Body.String()
+	if !strings.Contains(body, fmt.Sprintf("/devices/%d'", device.ID)) ||
+		strings.Contains(body, fmt.Sprintf("/tokens/%d/revoke", device.ApiTokenID)) {
+		t.Errorf("GET /tokens does not link the token to its device")
+	}
+
+	target := fmt.Sprintf("/tokens/%d/revoke", device.ApiTokenID)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w = serve(s, method, target, csrf, cookies)
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s %s status = %d, want %d", method, target, w.Code, http.StatusConflict)
+		}
+	}
+	if code := heartbeat(s, token); code != http.StatusOK {
+		t.Fatalf("heartbeat status = %d after revoking, want %d", code, http.StatusOK)
+	}
+
+	// Regenerating it revokes the current one, and the device keeps the new one.
+	w = serve(s, http.MethodPost, fmt.Sprintf("/devices/%d/token", device.ID), csrf, cookies)
+	m = newTokenRegexp.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || m == nil {
+		t.Fatalf("regenerate status = %d without a token, want %d with one", w.Code, http.StatusOK)
+	}
+	if code := heartbeat(s, m[1]); code != http.StatusOK {
+		t.Errorf("heartbeat status = %d with the new token, want %d", code, http.StatusOK)
+	}
+	if code := heartbeat(s, token); code != http.StatusUnauthorized {
+		t.Errorf("heartbeat status = %d with the old token, want %d", code, http.StatusUnauthorized)
+	}
+
+	device, err = s.db.GetDevice(ctx, device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.FirmwareVersion != "1.0" || !strings.HasPrefix(m[1], device.ApiToken.Prefix) {
+		t.Errorf("device has token %s… and firmware %q, want the new token and its status kept", device.ApiToken.Prefix, device.FirmwareVersion)
+	}
+}
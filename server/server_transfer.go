@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxImportUpload is the size limit of the files imported from the dashboard.
+const maxImportUpload = 32 << 20
+
+// getTransfer shows the links to export the collection, and the form to import
+// one.
+func (s *server) getTransfer(w http.ResponseWriter, r *http.Request) {
+	s.renderTransfer(w, r, http.StatusOK, nil)
+}
+
+func (s *server) renderTransfer(w http.ResponseWriter, r *http.Request, code int, report *importReport) {
+	s.renderTemplate(w, r, code, "transfer.html", map[string]interface{}{
+		"Title":         "Import & Export",
+		"ConflictModes": conflictModes,
+		"Report":        report,
+	})
+}
+
+// getExport downloads the file named after what is exported and its format,
+// such as albums.csv.
+func (s *server) getExport(w http.ResponseWriter, r *http.Request) {
+	what, format, _ := strings.Cut(chi.URLParam(r, "file"), ".")
+	err := parseExportRequest(what, format)
+	if err != nil {
+		s.renderError(w, r, http.StatusNotFound, err)
+		return
+	}
+
+	c, err := exportCollection(r.Context(), s.db, what)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	name := fmt.Sprintf("vinyl-%s-%s.%s", what, time.Now().Format(time.DateOnly), format)
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	err = writeCollection(w, c, what, format)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *server) postImport(w http.ResponseWriter, r *http.Request) {
+	f, header, code, err := importUpload(r)
+	if err != nil {
+		s.renderError(w, r, code, err)
+		return
+	}
+	defer f.Close()
+
+	format, err := importFormat(header.Filename, r.Form.Get("format"))
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	c, err := readCollection(f, format)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	report, err := importCollection(r.Context(), s.db, c, r.Form.Get("on_conflict"), r.Form.Get("dry_run") == "on")
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	s.renderTransfer(w, r, http.StatusOK, report)
+}
+
+// importUpload returns the file uploaded to be imported. On error, it returns
+// the status code to respond with.
+func importUpload(r *http.Request) (multipart.File, *multipart.FileHeader, int, error) {
+	err := r.ParseMultipartForm(maxImportUpload)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	f, header, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil, http.StatusBadRequest, errors.New("file is missing")
+	} else if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	return f, header, 0, nil
+}
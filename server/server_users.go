@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the minimum length of the passwords of the users.
+const minPasswordLength = 8
+
+var errSelfUpdate = errors.New("you cannot change your own role or delete yourself")
+
+// hashPassword validates the password and returns its bcrypt hash.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func parseRole(role string) (string, error) {
+	if !slices.Contains(allRoles, role) {
+		return "", errors.New("invalid role: " + role)
+	}
+	return role, nil
+}
+
+func (s *server) getUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetUsers(r.Context())
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "users.html", map[string]interface{}{
+		"Title":      "Users",
+		"Users":      users,
+		"Roles":      allRoles,
+		"ConfigUser": s.configUser(),
+	})
+}
+
+func (s *server) postNewUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	username := strings.TrimSpace(r.Form.Get("username"))
+	if username == "" {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("username is missing"))
+		return
+	}
+
+	if user := s.configUser(); user != nil && user.Username == username {
+		s.renderError(w, r, http.StatusConflict, errors.New("username is taken by the admin from the configuration"))
+		return
+	}
+
+	role, err := parseRole(r.Form.Get("role"))
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	hash, err := hashPassword(r.Form.Get("password"))
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.db.CreateUser(r.Context(), &User{Username: username, PasswordHash: hash, Role: role})
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/users", http.StatusSeeOther)
+}
+
+func (s *server) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.db.GetUser(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "user.html", map[string]interface{}{
+		"Title":   "Update User",
+		"Account": user,
+		"Roles":   allRoles,
+	})
+}
+
+func (s *server) postUser(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.db.GetUser(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	role, err := parseRole(r.Form.Get("role"))
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Admins cannot lock themselves out.
+	if role != user.Role && user.ID == userFromContext(r.Context()).ID {
+		s.renderError(w, r, http.StatusBadRequest, errSelfUpdate)
+		return
+	}
+	user.Role = role
+
+	// The password is only changed if a new one is given.
+	password := r.Form.Get("password")
+	if password != "" {
+		user.PasswordHash, err = hashPassword(password)
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	err = s.db.UpdateUser(r.Context(), user)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Whoever knew the old password is logged out, except the admin changing
+	// their own.
+	if password != "" {
+		var current uint64
+		if session := sessionFromContext(r.Context()); session != nil && session.UserID == user.ID {
+			current = session.ID
+		}
+
+		err = s.db.DeleteUserSessions(r.Context(), user.ID, current)
+		if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, s.basePath+"/users", http.StatusSeeOther)
+}
+
+func (s *server) getDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.db.GetUser(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.renderTemplate(w, r, http.StatusOK, "user-delete.html", map[string]interface{}{
+		"Title":   "Delete User",
+		"Account": user,
+	})
+}
+
+func (s *server) postDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := extractID(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.db.GetUser(r.Context(), id)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if user.ID == userFromContext(r.Context()).ID {
+		s.renderError(w, r, http.StatusBadRequest, errSelfUpdate)
+		return
+	}
+
+	err = s.db.DeleteUser(r.Context(), user.ID)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.db.DeleteUserSessions(r.Context(), user.ID, 0)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, s.basePath+"/users", http.StatusSeeOther)
+}
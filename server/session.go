@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	sessionCookie = "session"
+
+	// sessionRenewInterval is how often the expiration of a session in use is
+	// pushed back. Sessions are not renewed on every request to save writes.
+	sessionRenewInterval = time.Minute
+
+	// secretFile is the name of the generated secret in the data directory.
+	secretFile = "secret"
+
+	minSecretLength = 32
+)
+
+// loadSecret returns the configured secret or, if there is none, the one in
+// the data directory, which is generated the first time. Short secrets are
+// refused, as they could be guessed.
+func loadSecret(secret, dataDir string) ([]byte, error) {
+	if secret != "" {
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret must have at least %d characters, or be unset to generate one", minSecretLength)
+		}
+		return []byte(secret), nil
+	}
+
+	path := filepath.Join(dataDir, secretFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		secret = strings.TrimSpace(string(data))
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret in %s must have at least %d characters", path, minSecretLength)
+		}
+		return []byte(secret), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	secret = hex.EncodeToString(b)
+
+	err = os.WriteFile(path, []byte(secret+"\n"), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not save the generated secret: %w", err)
+	}
+
+	slog.Info("generated a new secret", "path", path)
+	return []byte(secret), nil
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// startSession creates a session for the user and sets its cookie. Only the
+// hash of the token in the cookie is stored.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, user *User) error {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now()
+	session := &Session{
+		TokenHash:  hashSessionToken(token),
+		UserID:     user.ID,
+		UserAgent:  r.UserAgent(),
+		IP:         s.clientIP(r),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.sessionLifetime),
+	}
+
+	err = s.db.CreateSession(r.Context(), session)
+	if err != nil {
+		return err
+	}
+
+	// Take the chance to clean up the sessions that expired meanwhile.
+	err = s.db.DeleteExpiredSessions(r.Context(), now)
+	if err != nil {
+		slog.Warn("could not delete expired sessions", "error", err)
+	}
+
+	s.setSessionCookie(w, r, token, session.ExpiresAt)
+	return nil
+}
+
+func (s *server) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Expires:  expires,
+		Secure:   s.isSecure(r),
+		HttpOnly: true,
+		Path:     s.basePath + "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *server) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   s.isSecure(r),
+		Path:     s.basePath + "/",
+		HttpOnly: true,
+	})
+}
+
+// currentSession returns the session of the request and its user, or nil if
+// there is no valid session. Users are loaded on every request, so that
+// changes to their role apply right away.
+func (s *server) currentSession(r *http.Request) (*Session, *User) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	session, err := s.db.GetSession(r.Context(), hashSessionToken(cookie.Value), time.Now())
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("could not load session", "error", err)
+		}
+		return nil, nil
+	}
+
+	if session.UserID == 0 {
+		user := s.configUser()
+		if user == nil {
+			return nil, nil
+		}
+		return session, user
+	}
+
+	user, err := s.db.GetUser(r.Context(), session.UserID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("could not load session user", "error", err)
+		}
+		return nil, nil
+	}
+	return session, user
+}
+
+// renewSession pushes back the expiration of the session in use, along with
+// its cookie.
+func (s *server) renewSession(w http.ResponseWriter, r *http.Request, session *Session) {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionRenewInterval {
+		return
+	}
+
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(s.sessionLifetime)
+	session.IP = s.clientIP(r)
+	session.UserAgent = r.UserAgent()
+
+	err := s.db.RenewSession(r.Context(), session)
+	if err != nil {
+		slog.Warn("could not renew session", "error", err)
+		return
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err == nil {
+		s.setSessionCookie(w, r, cookie.Value, session.ExpiresAt)
+	}
+}
+
+// isSecure returns whether the request was made over HTTPS, either to the
+// server, to the trusted proxy in front of it, or to the base URL, so that the
+// cookies are only sent back over HTTPS.
+func (s *server) isSecure(r *http.Request) bool {
+	if r.TLS != nil || strings.HasPrefix(s.baseURL, "https://") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(remoteHost(r))
+	return err == nil && s.isTrustedProxy(addr) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// csrfSessionToken returns the token of the session cookie, which the CSRF
+// tokens are derived from.
+func csrfSessionToken(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+type sessionContextKey struct{}
+
+// sessionFromContext returns the session of the logged in user, or nil if
+// there is none.
+func sessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return session
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	telegramPollTimeout = 30
+	telegramMaxLast     = 50
+)
+
+const telegramHelp = `Reply to an unknown tag message with "Artist - Album" to create the album and log the play.
+
+/now - show what is on the shelf
+/last [n] - show the last n plays
+/top [week|month|year|all] - show the most played albums
+/undo - delete the last play`
+
+// poll long-polls the Telegram Bot API for new messages and answers them,
+// until the context is cancelled.
+func (t *telegramBot) poll(ctx context.Context) {
+	offset := 0
+	for {
+		var updates []*telegramUpdate
+		err := t.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         telegramPollTimeout,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			slog.Warn("failed to get telegram updates", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = max(offset, update.UpdateID+1)
+			if update.Message != nil {
+				t.handleMessage(ctx, update.Message)
+			}
+		}
+	}
+}
+
+func (t *telegramBot) handleMessage(ctx context.Context, msg *telegramMessage) {
+	if !slices.Contains(t.chatIDs, msg.Chat.ID) {
+		slog.Warn("ignoring telegram message from unknown chat", "chat", msg.Chat.ID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	var reply string
+	var err error
+
+	text := strings.TrimSpace(msg.Text)
+	if strings.HasPrefix(text, "/") {
+		reply, err = t.handleCommand(ctx, text)
+	} else {
+		reply, err = t.handleRegister(ctx, msg, text)
+	}
+	if err != nil {
+		slog.Error("could not handle telegram message", "error", err)
+		reply = fmt.Sprintf("Something went wrong: %s", err)
+	}
+
+	_, err = t.sendMessage(ctx, msg.Chat.ID, reply)
+	if err != nil {
+		slog.Warn("failed to reply to telegram message", "error", err)
+	}
+}
+
+func (t *telegramBot) handleCommand(ctx context.Context, text string) (string, error) {
+	fields := strings.Fields(text)
+	command, _, _ := strings.Cut(fields[0], "@")
+	args := fields[1:]
+
+	switch command {
+	case "/now":
+		return t.commandNow(ctx)
+	case "/last":
+		return t.commandLast(ctx, args)
+	case "/top":
+		return t.commandTop(ctx, args)
+	case "/undo":
+		return t.commandUndo(ctx)
+	default:
+		return telegramHelp, nil
+	}
+}
+
+func (t *telegramBot) commandNow(ctx context.Context) (string, error) {
+	logs, err := t.s.db.GetOpenPlays(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(logs) == 0 {
+		return "Nothing is on the shelf.", nil
+	}
+
+	var sb strings.Builder
+	for _, log := range logs {
+		fmt.Fprintf(&sb, "Playing %s%s since %s.\n", log.Album.String(), onDevice(log.Device), log.Time.Format("15:04"))
+	}
+	return sb.String(), nil
+}
+
+func (t *telegramBot) commandLast(ctx context.Context, args []string) (string, error) {
+	n := 5
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return "Usage: /last [n]", nil
+		}
+		n = min(n, telegramMaxLast)
+	}
+
+	logs, err := t.s.db.GetLogs(ctx, LogFilter{}, "desc", 0, n)
+	if err != nil {
+		return "", err
+	}
+
+	if len(logs) == 0 {
+		return "Nothing was played yet.", nil
+	}
+
+	var sb strings.Builder
+	for _, log := range logs {
+		fmt.Fprintf(&sb, "%s %s%s\n", log.Time.Format("2006-01-02 15:04"), log.Album.String(), onDevice(log.Device))
+	}
+	return sb.String(), nil
+}
+
+func (t *telegramBot) commandTop(ctx context.Context, args []string) (string, error) {
+	window := statsWindows[1]
+	if len(args) > 0 {
+		i := slices.IndexFunc(statsWindows, func(w statsWindow) bool { return w.Name == args[0] })
+		if i == -1 {
+			return "Usage: /top [week|month|year|all]", nil
+		}
+		window = statsWindows[i]
+	}
+
+	plays, err := t.s.db.GetTopAlbums(ctx, window.since(time.Now()), statsTopSize)
+	if err != nil {
+		return "", err
+	}
+
+	if len(plays) == 0 {
+		return "Nothing was played in this period.", nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Top albums (%s):\n", window.Label)
+	for i, p := range plays {
+		fmt.Fprintf(&sb, "%d. %s (%d plays)\n", i+1, p.Album.String(), p.Plays)
+	}
+	return sb.String(), nil
+}
+
+func (t *telegramBot) commandUndo(ctx context.Context) (string, error) {
+	t.s.playsMu.Lock()
+	defer t.s.playsMu.Unlock()
+
+	log, err := t.s.db.GetLatestLog(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "There is nothing to undo.", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	err = t.s.deleteLog(ctx, log.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Deleted the play of %s at %s.", log.Album.String(), log.Time.Format("2006-01-02 15:04")), nil
+}
+
+// handleRegister creates an album for an unknown tag from a "Artist - Album"
+// message, and logs the play. The tag is the one from the message being
+// replied to or, otherwise, the latest unknown tag.
+func (t *telegramBot) handleRegister(ctx context.Context, msg *telegramMessage, text string) (string, error) {
+	artist, name, ok := strings.Cut(text, " - ")
+	artist, name = strings.TrimSpace(artist), strings.TrimSpace(name)
+	if !ok || artist == "" || name == "" {
+		return telegramHelp, nil
+	}
+
+	replyTo := 0
+	if msg.ReplyToMessage != nil {
+		replyTo = msg.ReplyToMessage.MessageID
+	}
+
+	pending, ok := t.takePendingTag(msg.Chat.ID, replyTo)
+	if !ok {
+		return "There is no unknown tag to create the album for.", nil
+	}
+
+	_, err := t.s.db.GetAlbumByTag(ctx, pending.Tag)
+	if err == nil {
+		return fmt.Sprintf("The tag %s already belongs to an album.", pending.Tag), nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.putBackPendingTag(msg.Chat.ID, pending)
+		return "", err
+	}
+
+	album := &Album{
+		Name:   name,
+		Artist: artist,
+	}
+
+	// The plays are logged at the time of the scans of the tag, unless they
+	// were dismissed from the inbox meanwhile. The album is only created along
+	// with them, so that the reply can be sent again if anything fails.
+	var logs []*Log
+	err = t.s.db.Transaction(ctx, func(tx *database) error {
+		err := tx.CreateAlbum(ctx, album)
+		if err != nil {
+			return err
+		}
+		logs, err = tx.AssignUnknownScans(ctx, pending.Tag, album)
+		return err
+	})
+	if err != nil {
+		t.putBackPendingTag(msg.Chat.ID, pending)
+		return "", err
+	}
+	t.s.scrobbleAssignedScans(ctx, pending.Tag, album, logs)
+
+	switch len(logs) {
+	case 0:
+		return fmt.Sprintf("Created album %s.", album.String()), nil
+	case 1:
+		return fmt.Sprintf("Created album %s and logged the play.", album.String()), nil
+	default:
+		return fmt.Sprintf("Created album %s and logged its %d plays.", album.String(), len(logs)), nil
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	testTelegramToken  = "123:secret"
+	testTelegramChatID = 42
+)
+
+// fakeTelegram is a Telegram Bot API that hands out the queued updates to
+// getUpdates and records the messages sent.
+type fakeTelegram struct {
+	updates chan []*telegramUpdate
+	sent    chan *telegramMessage
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *httptest.Server) {
+	f := &fakeTelegram{
+		updates: make(chan []*telegramUpdate, 10),
+		sent:    make(chan *telegramMessage, 10),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		switch r.URL.Path {
+		case "/bot" + testTelegramToken + "/getUpdates":
+			// The context of the request is only canceled when the bot goes
+			// away once its body was read.
+			_, _ = io.Copy(io.Discard, r.Body)
+			select {
+			case updates := <-f.updates:
+				result = updates
+			case <-r.Context().Done():
+				return
+			}
+		case "/bot" + testTelegramToken + "/sendMessage":
+			var params struct {
+				ChatID int64  `json:"chat_id"`
+				Text   string `json:"text"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&params)
+			if err != nil {
+				http.Error(w, `{"ok":false,"description":"Bad Request"}`, http.StatusBadRequest)
+				return
+			}
+			msg := &telegramMessage{MessageID: 1000, Chat: telegramChat{ID: params.ChatID}, Text: params.Text}
+			f.sent <- msg
+			result = msg
+		default:
+			http.Error(w, `{"ok":false,"description":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+	}))
+	t.Cleanup(ts.Close)
+
+	return f, ts
+}
+
+// reply waits for the bot to send a message to the chat.
+func (f *fakeTelegram) reply(t *testing.T) string {
+	t.Helper()
+	select {
+	case msg := <-f.sent:
+		if msg.Chat.ID != testTelegramChatID {
+			t.Errorf("sent message %q to chat %d, want %d", msg.Text, msg.Chat.ID, testTelegramChatID)
+		}
+		return msg.Text
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bot did not reply")
+		return ""
+	}
+}
+
+func TestTelegramBotRegisterAndUndo(t *testing.T) {
+	f, ts := newFakeTelegram(t)
+	s := newTestServer(t, config{
+		tgAPIURL:  ts.URL,
+		tgToken:   testTelegramToken,
+		tgChatIDs: []int64{testTelegramChatID},
+		tgBot:     true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.telegram.poll(ctx)
+
+	// The notification of an unknown tag is message 7 of the chat.
+	scanTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	_, _, err := s.db.CreateUnknownScan(ctx, "04A1B2C3", nil, 0, scanTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.telegram.addPendingTag(testTelegramChatID, pendingTag{MessageID: 7, Tag: "04A1B2C3"})
+
+	f.updates <- []*telegramUpdate{{
+		UpdateID: 1,
+		Message: &telegramMessage{
+			MessageID:      8,
+			Chat:           telegramChat{ID: testTelegramChatID},
+			Text:           "Daft Punk - Discovery",
+			ReplyToMessage: &telegramMessage{MessageID: 7},
+		},
+	}}
+	if got, want := f.reply(t), `Created album "Discovery" by Daft Punk and logged the play.`; got != want {
+		t.Errorf("reply = %q, want %q", got, want)
+	}
+
+	album, err := s.db.GetAlbumByTag(ctx, "04A1B2C3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if album.Artist != "Daft Punk" || album.Name != "Discovery" {
+		t.Errorf("album = %s, want \"Discovery\" by Daft Punk", album.String())
+	}
+
+	log, err := s.db.GetLatestLog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.AlbumID != album.ID || !log.Time.Equal(scanTime) {
+		t.Errorf("logged album %d at %s, want album %d at %s", log.AlbumID, log.Time, album.ID, scanTime)
+	}
+
+	f.updates <- []*telegramUpdate{{
+		UpdateID: 2,
+		Message: &telegramMessage{
+			MessageID: 9,
+			Chat:      telegramChat{ID: testTelegramChatID},
+			Text:      "/undo",
+		},
+	}}
+	if got := f.reply(t); !strings.HasPrefix(got, `Deleted the play of "Discovery" by Daft Punk at `) {
+		t.Errorf("reply = %q, want the deleted play", got)
+	}
+
+	_, err = s.db.GetLatestLog(ctx)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("GetLatestLog() error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestTelegramBotIgnoresUnknownChats(t *testing.T) {
+	f, ts := newFakeTelegram(t)
+	s := newTestServer(t, config{
+		tgAPIURL:  ts.URL,
+		tgToken:   testTelegramToken,
+		tgChatIDs: []int64{testTelegramChatID},
+		tgBot:     true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.telegram.poll(ctx)
+
+	f.updates <- []*telegramUpdate{
+		{UpdateID: 1, Message: &telegramMessage{MessageID: 1, Chat: telegramChat{ID: 666}, Text: "/undo"}},
+		{UpdateID: 2, Message: &telegramMessage{MessageID: 2, Chat: telegramChat{ID: testTelegramChatID}, Text: "/undo"}},
+	}
+	if got, want := f.reply(t), "There is nothing to undo."; got != want {
+		t.Errorf("reply = %q, want %q", got, want)
+	}
+}
+
+func TestTelegramBotRegisterFails(t *testing.T) {
+	f, ts := newFakeTelegram(t)
+	s := newTestServer(t, config{
+		tgAPIURL:  ts.URL,
+		tgToken:   testTelegramToken,
+		tgChatIDs: []int64{testTelegramChatID},
+		tgBot:     true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.telegram.poll(ctx)
+
+	s.telegram.addPendingTag(testTelegramChatID, pendingTag{MessageID: 7, Tag: "04A1B2C3"})
+	s.telegram.addPendingTag(testTelegramChatID, pendingTag{MessageID: 10, Tag: "04D4E5F6"})
+
+	// Without the inbox, the scans cannot be assigned.
+	err := s.db.db.Migrator().DropTable(&UnknownScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := &telegramMessage{
+		MessageID:      8,
+		Chat:           telegramChat{ID: testTelegramChatID},
+		Text:           "Daft Punk - Discovery",
+		ReplyToMessage: &telegramMessage{MessageID: 7},
+	}
+	f.updates <- []*telegramUpdate{{UpdateID: 1, Message: reply}}
+	if got := f.reply(t); !strings.HasPrefix(got, "Something went wrong: ") {
+		t.Errorf("reply = %q, want an error", got)
+	}
+
+	total, err := s.db.CountAlbums(ctx, AlbumFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 {
+		t.Errorf("%d albums created, want none", total)
+	}
+
+	// The tag is put back before the one notified after it.
+	s.telegram.pendingMu.Lock()
+	var tags []string
+	for _, p := range s.telegram.pending[testTelegramChatID] {
+		tags = append(tags, p.Tag)
+	}
+	s.telegram.pendingMu.Unlock()
+	if !slices.Equal(tags, []string{"04A1B2C3", "04D4E5F6"}) {
+		t.Errorf("pending tags = %v, want [04A1B2C3 04D4E5F6]", tags)
+	}
+
+	// The same reply works once the inbox is back.
+	err = s.db.db.AutoMigrate(&UnknownScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.updates <- []*telegramUpdate{{UpdateID: 2, Message: reply}}
+	if got, want := f.reply(t), `Created album "Discovery" by Daft Punk.`; got != want {
+		t.Errorf("reply = %q, want %q", got, want)
+	}
+	assertAlbumTags(t, s, 1, "04A1B2C3")
+}
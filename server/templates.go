@@ -4,9 +4,9 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net/http"
-	"text/template"
 
 	"gorm.io/gorm"
 )
@@ -14,25 +14,69 @@ import (
 var (
 	//go:embed templates/*.html
 	templatesFS embed.FS
-	templates   = template.Must(template.ParseFS(templatesFS, "templates/*.html"))
 
 	//go:embed assets/*
 	assetsFS embed.FS
 )
 
-func (s *server) renderTemplate(w http.ResponseWriter, code int, template string, data interface{}) {
+// newTemplates parses the templates. The basePath function returns the path
+// of the base URL, which the links of the templates start with.
+func newTemplates(basePath string) (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"navigation": navigation,
+		"basePath":   func() string { return basePath },
+	}).ParseFS(templatesFS, "templates/*.html")
+}
+
+// navigation returns the data of the navigation bar, where page is the
+// current section, and inbox the number of unknown scans waiting in the inbox.
+func navigation(page string, user *User, inbox int64) map[string]interface{} {
+	return map[string]interface{}{
+		"Page":  page,
+		"User":  user,
+		"Inbox": inbox,
+	}
+}
+
+// renderTemplate renders the template. If the data is a map, the logged in
+// user and the CSRF token for the forms are added to it as User and CSRFToken,
+// and the number of unknown scans in the inbox as Inbox.
+func (s *server) renderTemplate(w http.ResponseWriter, r *http.Request, code int, template string, data interface{}) {
+	if m, ok := data.(map[string]interface{}); ok {
+		user := userFromContext(r.Context())
+		m["User"] = user
+		m["CSRFToken"] = s.csrfToken(r)
+		m["Inbox"] = int64(0)
+		if user != nil {
+			m["Inbox"] = s.inboxCount(r.Context())
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(code)
-	err := templates.ExecuteTemplate(w, template, data)
+	err := s.templates.ExecuteTemplate(w, template, data)
 	if err != nil {
 		slog.Error("serving html", "error.html", err)
 	}
 }
 
-func (s *server) renderError(w http.ResponseWriter, code int, reqErr error) {
-	if errors.Is(reqErr, gorm.ErrRecordNotFound) {
-		code = http.StatusNotFound
+// errorStatusCode returns the status code that better describes the error, or
+// the given code if there is none.
+func errorStatusCode(code int, err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return http.StatusConflict
+	case errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return code
 	}
+}
+
+func (s *server) renderError(w http.ResponseWriter, r *http.Request, code int, reqErr error) {
+	code = errorStatusCode(code, reqErr)
 
 	data := map[string]interface{}{
 		"Title":  fmt.Sprintf("%d %s", code, http.StatusText(code)),
@@ -44,5 +88,5 @@ func (s *server) renderError(w http.ResponseWriter, code int, reqErr error) {
 		data["Message"] = reqErr.Error()
 	}
 
-	s.renderTemplate(w, code, "error.html", data)
+	s.renderTemplate(w, r, code, "error.html", data)
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var xssPayloads = []string{
+	`<script>alert(1)</script>`,
+	`'"><img src=x onerror=alert(1)>`,
+	`javascript:alert(1)`,
+}
+
+// javascriptURLRegexp matches the attributes that would run a javascript: URL.
+var javascriptURLRegexp = regexp.MustCompile(`(?i)(href|src|action|formaction)\s*=\s*['"]?\s*javascript:`)
+
+// assertEscaped checks that the payload only appears escaped in the page, and
+// never as a URL to follow.
+func assertEscaped(t *testing.T, page, body, payload string) {
+	t.Helper()
+
+	if strings.ContainsAny(payload, `<>'"`) {
+		if strings.Contains(body, payload) {
+			t.Errorf("%s contains %q unescaped", page, payload)
+		}
+		if !strings.Contains(body, template.HTMLEscapeString(payload)) {
+			t.Errorf("%s does not contain %q escaped", page, payload)
+		}
+	}
+	if m := javascriptURLRegexp.FindString(body); m != "" {
+		t.Errorf("%s links to a javascript URL: %s", page, m)
+	}
+}
+
+func TestTemplatesEscapeAlbums(t *testing.T) {
+	s := newTestServer(t, config{})
+	cookies := login(t, s)
+	ctx := context.Background()
+
+	for _, payload := range xssPayloads {
+		album := &Album{Name: payload, Artist: payload}
+		err := s.db.CreateAlbum(ctx, album)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.db.SetAlbumTags(ctx, album, []string{payload}, false, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.db.CreateLog(ctx, album)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := url.QueryEscape(payload)
+		for _, page := range []string{
+			"/albums",
+			"/albums?view=wall",
+			"/albums?q=" + q,
+			fmt.Sprintf("/albums/%d", album.ID),
+			"/logs",
+			"/logs?artist=" + q,
+		} {
+			w := serve(s, http.MethodGet, page, nil, cookies)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s status = %d, want %d", page, w.Code, http.StatusOK)
+			}
+			assertEscaped(t, page, w.Body.String(), payload)
+		}
+	}
+}
+
+func TestMustCSRFToken(t *testing.T) {
+	s := newTestServer(t, config{})
+	cookies := login(t, s)
+	ctx := context.Background()
+
+	album := &Album{Name: "Discovery", Artist: "Daft Punk"}
+	err := s.db.CreateAlbum(ctx, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/albums/%d/delete", album.ID)
+
+	for _, tc := range []struct {
+		name string
+		form url.Values
+	}{
+		{"missing", url.Values{}},
+		{"empty", url.Values{csrfFormField: {""}}},
+		{"wrong", url.Values{csrfFormField: {"not-the-token"}}},
+	} {
+		w := serve(s, http.MethodPost, target, tc.form, cookies)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s token: status = %d, want %d", tc.name, w.Code, http.StatusForbidden)
+		}
+		_, err = s.db.GetAlbum(ctx, album.ID)
+		if err != nil {
+			t.Fatalf("%s token: album was deleted: %v", tc.name, err)
+		}
+	}
+
+	// The token of another session is not valid either.
+	other := login(t, s)
+	w := serve(s, http.MethodPost, target, url.Values{csrfFormField: {csrfTokenFor(s, other)}}, cookies)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("token of another session: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serve(s, http.MethodPost, target, url.Values{csrfFormField: {csrfTokenFor(s, cookies)}}, cookies)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("valid token: status = %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	_, err = s.db.GetAlbum(ctx, album.ID)
+	if err == nil {
+		t.Error("valid token: album was not deleted")
+	}
+}
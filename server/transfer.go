@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// What to do when an imported album has the tag, or if it has none, the name
+// and artist of an existing one.
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictFail      = "fail"
+)
+
+var conflictModes = []string{conflictSkip, conflictOverwrite, conflictFail}
+
+// Which part of the collection to export.
+const (
+	exportAlbums = "albums"
+	exportLogs   = "logs"
+	exportAll    = "all"
+)
+
+// errDryRun rolls back the imports that are only tried.
+var errDryRun = errors.New("dry run")
+
+var (
+	albumColumns = []string{"tags", "name", "artist", "year", "label", "catalog_number", "barcode", "genres", "tracklist", "mbid"}
+	logColumns   = []string{"time", "end_time", "album_tag", "album_name", "album_artist", "device"}
+)
+
+// logTimeLayouts are the layouts accepted for the times of the logs in CSV
+// files, besides RFC 3339, as spreadsheets tend to drop the time zone.
+var logTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// collection is the albums and the logs as exported and imported. Logs refer
+// to their album by its first tag, or if it has none, by its name and artist,
+// as IDs are not kept across databases.
+type collection struct {
+	Albums []*exportAlbum `json:"albums"`
+	Logs   []*exportLog   `json:"logs"`
+}
+
+// Albums from before they could have several tags have a single tag, which
+// is only read on import.
+type exportAlbum struct {
+	Tags          []string `json:"tags"`
+	Tag           string   `json:"tag,omitempty"`
+	Name          string   `json:"name"`
+	Artist        string   `json:"artist"`
+	Year          int      `json:"year,omitempty"`
+	Label         string   `json:"label,omitempty"`
+	CatalogNumber string   `json:"catalog_number,omitempty"`
+	Barcode       string   `json:"barcode,omitempty"`
+	Genres        []string `json:"genres,omitempty"`
+	Tracklist     []string `json:"tracklist,omitempty"`
+	MBID          string   `json:"mbid,omitempty"`
+}
+
+func newExportAlbum(album *Album) *exportAlbum {
+	return &exportAlbum{
+		Tags:          album.TagList(),
+		Name:          album.Name,
+		Artist:        album.Artist,
+		Year:          album.Year,
+		Label:         album.Label,
+		CatalogNumber: album.CatalogNumber,
+		Barcode:       album.Barcode,
+		Genres:        album.GenreList(),
+		Tracklist:     album.TrackList(),
+		MBID:          album.MBID,
+	}
+}
+
+// apply sets the fields of the album to the imported ones, except for the
+// tags, which are set with SetAlbumTags.
+func (a *exportAlbum) apply(album *Album) {
+	album.Name = a.Name
+	album.Artist = a.Artist
+	album.Year = a.Year
+	album.Label = a.Label
+	album.CatalogNumber = a.CatalogNumber
+	album.Barcode = a.Barcode
+	album.Genres = strings.Join(a.Genres, ", ")
+	album.Tracklist = strings.Join(a.Tracklist, "\n")
+	album.MBID = a.MBID
+}
+
+// The album name and artist are only used on import for untagged albums, and
+// the device is only exported for the humans reading the file.
+type exportLog struct {
+	Time        time.Time  `json:"time"`
+	EndTime     *time.Time `json:"end_time,omitempty"`
+	AlbumTag    string     `json:"album_tag"`
+	AlbumName   string     `json:"album_name,omitempty"`
+	AlbumArtist string     `json:"album_artist,omitempty"`
+	Device      string     `json:"device,omitempty"`
+}
+
+func newExportLog(log *Log) *exportLog {
+	l := &exportLog{
+		Time:        log.Time,
+		EndTime:     log.EndTime,
+		AlbumTag:    firstTag(log.Album.TagList()),
+		AlbumName:   log.Album.Name,
+		AlbumArtist: log.Album.Artist,
+	}
+	if log.Device != nil {
+		l.Device = log.Device.String()
+	}
+	return l
+}
+
+// exportCollection returns the albums, the logs or both, oldest logs first.
+func exportCollection(ctx context.Context, db *database, what string) (*collection, error) {
+	c := &collection{Albums: []*exportAlbum{}, Logs: []*exportLog{}}
+
+	if what == exportAlbums || what == exportAll {
+		albums, err := db.GetAlbums(ctx, AlbumFilter{}, "name", "asc", 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			c.Albums = append(c.Albums, newExportAlbum(album))
+		}
+	}
+
+	if what == exportLogs || what == exportAll {
+		logs, err := db.GetLogs(ctx, LogFilter{}, "asc", 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		for _, log := range logs {
+			// The logs of deleted albums cannot be imported back.
+			if log.Album.ID == 0 {
+				continue
+			}
+			c.Logs = append(c.Logs, newExportLog(log))
+		}
+	}
+
+	return c, nil
+}
+
+// parseExportRequest validates what to export and in which format. CSV files
+// only have one table, so they cannot have both the albums and the logs.
+func parseExportRequest(what, format string) error {
+	if !slices.Contains([]string{exportAlbums, exportLogs, exportAll}, what) {
+		return fmt.Errorf("cannot export %q, only albums, logs or all", what)
+	}
+
+	switch format {
+	case formatJSON:
+		return nil
+	case formatCSV:
+		if what == exportAll {
+			return errors.New("csv files have either the albums or the logs, export them one at a time")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, only json or csv", format)
+	}
+}
+
+// writeCollection writes the exported collection in the format. CSV files have
+// the albums, if any, or the logs otherwise.
+func writeCollection(w io.Writer, c *collection, what, format string) error {
+	if format == formatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	}
+
+	cw := csv.NewWriter(w)
+	if what == exportAlbums {
+		_ = cw.Write(albumColumns)
+		for _, a := range c.Albums {
+			year := ""
+			if a.Year != 0 {
+				year = strconv.Itoa(a.Year)
+			}
+			_ = cw.Write([]string{
+				strings.Join(a.Tags, ", "), a.Name, a.Artist, year, a.Label, a.CatalogNumber, a.Barcode,
+				strings.Join(a.Genres, ", "), strings.Join(a.Tracklist, "\n"), a.MBID,
+			})
+		}
+	} else {
+		_ = cw.Write(logColumns)
+		for _, l := range c.Logs {
+			end := ""
+			if l.EndTime != nil {
+				end = l.EndTime.Format(time.RFC3339)
+			}
+			_ = cw.Write([]string{l.Time.Format(time.RFC3339), end, l.AlbumTag, l.AlbumName, l.AlbumArtist, l.Device})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// importFormat returns the format of the file to import, from its extension
+// unless it is given.
+func importFormat(name, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	}
+	if format != formatJSON && format != formatCSV {
+		return "", errors.New("unknown import format, only json or csv files can be imported")
+	}
+	return format, nil
+}
+
+// readCollection reads the collection to import. CSV files have either albums
+// or logs, which are told apart by their columns, and may have more columns
+// than the ones read, in any order.
+func readCollection(r io.Reader, format string) (*collection, error) {
+	c := &collection{}
+
+	if format == formatJSON {
+		err := json.NewDecoder(r).Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+
+		err = validateCollection(c)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("csv file is empty")
+	}
+
+	columns := csvColumns(records[0])
+	get := func(record []string, column string) string {
+		return csvValue(columns, record, column)
+	}
+
+	_, hasTime := columns["time"]
+	_, hasName := columns["name"]
+
+	var errs []error
+	for i, record := range records[1:] {
+		line := i + 2
+
+		switch {
+		case hasTime:
+			l := &exportLog{
+				AlbumTag:    get(record, "album_tag"),
+				AlbumName:   get(record, "album_name"),
+				AlbumArtist: get(record, "album_artist"),
+			}
+			l.Time, err = parseLogTime(get(record, "time"))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: invalid time: %w", line, err))
+				continue
+			}
+			if value := get(record, "end_time"); value != "" {
+				end, err := parseLogTime(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("line %d: invalid end_time: %w", line, err))
+					continue
+				}
+				l.EndTime = &end
+			}
+			if err := validateLog(l); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+				continue
+			}
+			c.Logs = append(c.Logs, l)
+
+		case hasName:
+			a := &exportAlbum{
+				Tags:          splitList(get(record, "tags"), ","),
+				Tag:           get(record, "tag"),
+				Name:          get(record, "name"),
+				Artist:        get(record, "artist"),
+				Label:         get(record, "label"),
+				CatalogNumber: get(record, "catalog_number"),
+				Barcode:       get(record, "barcode"),
+				Genres:        splitList(get(record, "genres"), ","),
+				Tracklist:     splitList(get(record, "tracklist"), "\n"),
+				MBID:          get(record, "mbid"),
+			}
+			if value := get(record, "year"); value != "" {
+				a.Year, err = strconv.Atoi(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("line %d: invalid year: %w", line, err))
+					continue
+				}
+			}
+			if err := validateAlbum(a); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+				continue
+			}
+			c.Albums = append(c.Albums, a)
+
+		default:
+			return nil, errors.New("csv file must have a name column for albums, or a time column for logs")
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return c, nil
+}
+
+// csvColumns maps the lowercased names in the header of a CSV file to their
+// index.
+func csvColumns(header []string) map[string]int {
+	columns := map[string]int{}
+	for i, name := range header {
+		// Spreadsheets may start the file with a byte order mark.
+		name = strings.TrimPrefix(name, "\ufeff")
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return columns
+}
+
+// csvValue returns the trimmed value of the column in the record, or an empty
+// string if there is no such column.
+func csvValue(columns map[string]int, record []string, column string) string {
+	i, ok := columns[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+func parseLogTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range logTimeLayouts {
+		t, lerr := time.ParseInLocation(layout, value, time.Local)
+		if lerr == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// validateCollection trims the imported values and checks that nothing that is
+// required is missing, so that nothing is imported from invalid files.
+func validateCollection(c *collection) error {
+	var errs []error
+	for i, a := range c.Albums {
+		if err := validateAlbum(a); err != nil {
+			errs = append(errs, fmt.Errorf("album %d: %w", i+1, err))
+		}
+	}
+	for i, l := range c.Logs {
+		if err := validateLog(l); err != nil {
+			errs = append(errs, fmt.Errorf("log %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateAlbum(a *exportAlbum) error {
+	if len(a.Tags) == 0 {
+		a.Tags = []string{a.Tag}
+	}
+	a.Tags = parseTags(strings.Join(a.Tags, ","))
+	a.Tag = ""
+	a.Name = strings.TrimSpace(a.Name)
+	a.Artist = strings.TrimSpace(a.Artist)
+	if a.Name == "" || a.Artist == "" {
+		return errors.New("name or artist is missing")
+	}
+	return nil
+}
+
+func validateLog(l *exportLog) error {
+	l.AlbumTag = strings.TrimSpace(l.AlbumTag)
+	l.AlbumName = strings.TrimSpace(l.AlbumName)
+	l.AlbumArtist = strings.TrimSpace(l.AlbumArtist)
+	switch {
+	case l.AlbumTag == "" && (l.AlbumName == "" || l.AlbumArtist == ""):
+		return errors.New("album_tag, or album_name and album_artist, are missing")
+	case l.Time.IsZero():
+		return errors.New("time is missing")
+	case l.EndTime != nil && l.EndTime.Before(l.Time):
+		return errors.New("end_time is before time")
+	}
+	return nil
+}
+
+// importReport tells what an import changed, or would change if it is a dry
+// run.
+type importReport struct {
+	DryRun bool
+
+	AlbumsCreated   int
+	AlbumsUpdated   int
+	AlbumsUnchanged int
+	AlbumsSkipped   int
+	LogsCreated     int
+	LogsSkipped     int
+
+	Changes []string
+}
+
+func (r *importReport) addChange(format string, args ...any) {
+	r.Changes = append(r.Changes, fmt.Sprintf(format, args...))
+}
+
+func (r *importReport) String() string {
+	var b strings.Builder
+	if r.DryRun {
+		b.WriteString("Dry run, nothing was imported.\n")
+	}
+	for _, change := range r.Changes {
+		b.WriteString(change + "\n")
+	}
+	fmt.Fprintf(&b, "Albums: %d created, %d updated, %d unchanged, %d skipped.\n", r.AlbumsCreated, r.AlbumsUpdated, r.AlbumsUnchanged, r.AlbumsSkipped)
+	fmt.Fprintf(&b, "Logs: %d created, %d skipped.\n", r.LogsCreated, r.LogsSkipped)
+	return b.String()
+}
+
+// importCollection imports the albums, and then the logs, all at once or none
+// at all. Albums are matched by tag, or by name and artist if they have no
+// tags, and conflict tells what to do when one
+// already exists. Logs of an album at the same time, to the second, as an
+// existing one are skipped, so that imports can be run again.
+func importCollection(ctx context.Context, db *database, c *collection, conflict string, dryRun bool) (*importReport, error) {
+	if !slices.Contains(conflictModes, conflict) {
+		return nil, fmt.Errorf("unknown conflict handling %q, only skip, overwrite or fail", conflict)
+	}
+
+	report := &importReport{DryRun: dryRun}
+	err := db.Transaction(ctx, func(tx *database) error {
+		for _, a := range c.Albums {
+			err := importAlbum(ctx, tx, a, conflict, report)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, l := range c.Logs {
+			err := importLog(ctx, tx, l, report)
+			if err != nil {
+				return err
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func importAlbum(ctx context.Context, db *database, a *exportAlbum, conflict string, report *importReport) error {
+	album, err := findImportedAlbum(ctx, db, a.Tags, a.Name, a.Artist)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		album = &Album{}
+		a.apply(album)
+		err = db.CreateAlbum(ctx, album)
+		if err != nil {
+			return fmt.Errorf("could not create %s: %w", album, err)
+		}
+		err = db.SetAlbumTags(ctx, album, a.Tags, false, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not tag %s: %w", album, err)
+		}
+		report.AlbumsCreated++
+		report.addChange("Created %s%s.", album, withTags(a.Tags))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Albums imported again are not conflicts.
+	updated := *album
+	a.apply(&updated)
+	if sameAlbum(album, &updated) && slices.Equal(album.TagList(), a.Tags) {
+		report.AlbumsUnchanged++
+		return nil
+	}
+
+	switch conflict {
+	case conflictFail:
+		return fmt.Errorf("%q%s matches the existing %s", a.Name, withTags(a.Tags), album)
+	case conflictSkip:
+		report.AlbumsSkipped++
+		report.addChange("Skipped %q%s, which matches the existing %s.", a.Name, withTags(a.Tags), album)
+		return nil
+	}
+
+	err = db.UpdateAlbum(ctx, &updated)
+	if err != nil {
+		return fmt.Errorf("could not update %s: %w", album, err)
+	}
+	// Overwriting also moves the tags that are on other albums.
+	err = db.SetAlbumTags(ctx, &updated, a.Tags, true, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not tag %s: %w", album, err)
+	}
+	report.AlbumsUpdated++
+	report.addChange("Updated %s to %s%s.", album, &updated, withTags(a.Tags))
+	return nil
+}
+
+// findImportedAlbum returns the existing album with one of the tags, or if
+// there are none, with the name and artist.
+func findImportedAlbum(ctx context.Context, db *database, tags []string, name, artist string) (*Album, error) {
+	if len(tags) == 0 {
+		return db.GetAlbumByName(ctx, name, artist)
+	}
+
+	for _, tag := range tags {
+		album, err := db.GetAlbumByTag(ctx, tag)
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return album, err
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// withTags describes the tags of an imported album.
+func withTags(tags []string) string {
+	switch len(tags) {
+	case 0:
+		return ""
+	case 1:
+		return " with the tag " + tags[0]
+	default:
+		return " with the tags " + strings.Join(tags, ", ")
+	}
+}
+
+func firstTag(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[0]
+}
+
+// sameAlbum returns whether the imported fields of the albums are the same,
+// besides their tags.
+func sameAlbum(a, b *Album) bool {
+	x, y := newExportAlbum(a), newExportAlbum(b)
+	return x.Name == y.Name && x.Artist == y.Artist && x.Year == y.Year &&
+		x.Label == y.Label && x.CatalogNumber == y.CatalogNumber && x.Barcode == y.Barcode &&
+		slices.Equal(x.Genres, y.Genres) && slices.Equal(x.Tracklist, y.Tracklist) && x.MBID == y.MBID
+}
+
+func importLog(ctx context.Context, db *database, l *exportLog, report *importReport) error {
+	var album *Album
+	var err error
+	if l.AlbumTag != "" {
+		album, err = db.GetAlbumByTag(ctx, l.AlbumTag)
+	} else {
+		album, err = db.GetAlbumByName(ctx, l.AlbumName, l.AlbumArtist)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) && l.AlbumTag != "" {
+		return fmt.Errorf("no album has the tag %s of the log at %s", l.AlbumTag, l.Time.Format(time.RFC3339))
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("no album is %q by %s, of the log at %s", l.AlbumName, l.AlbumArtist, l.Time.Format(time.RFC3339))
+	} else if err != nil {
+		return err
+	}
+
+	exists, err := db.HasLog(ctx, album.ID, l.Time)
+	if err != nil {
+		return err
+	}
+	if exists {
+		report.LogsSkipped++
+		return nil
+	}
+
+	err = db.SaveLog(ctx, &Log{Time: l.Time, EndTime: l.EndTime, AlbumID: album.ID})
+	if err != nil {
+		return err
+	}
+	report.LogsCreated++
+	return nil
+}
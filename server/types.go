@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,7 +14,66 @@ type Album struct {
 	ID     uint64
 	Name   string
 	Artist string
-	Tag    string `gorm:"unique"`
+	Tags   []*AlbumTag // Only the tags currently on the album.
+
+	// Metadata, typed by hand or filled from a metadata provider.
+	Year          int
+	Label         string
+	CatalogNumber string
+	Barcode       string
+	Genres        string // Comma-separated.
+	Tracklist     string // One track per line.
+	MBID          string
+	EnrichedAt    *time.Time
+
+	// Cover is the key of the cover image files, if there is a cover.
+	Cover string
+}
+
+func (a *Album) CoverURL() string {
+	return "/covers/" + a.Cover + ".jpg"
+}
+
+func (a *Album) ThumbnailURL() string {
+	return "/covers/" + a.Cover + "-thumb.jpg"
+}
+
+// TagList returns the tags currently on the album.
+func (a *Album) TagList() []string {
+	tags := make([]string, 0, len(a.Tags))
+	for _, t := range a.Tags {
+		tags = append(tags, t.Tag)
+	}
+	return tags
+}
+
+// FormatTags returns the tags of the album separated by commas.
+func (a *Album) FormatTags() string {
+	return strings.Join(a.TagList(), ", ")
+}
+
+func (a *Album) HasTag(tag string) bool {
+	return slices.Contains(a.TagList(), tag)
+}
+
+func (a *Album) GenreList() []string {
+	return splitList(a.Genres, ",")
+}
+
+func (a *Album) TrackList() []string {
+	return splitList(a.Tracklist, "\n")
+}
+
+// splitList splits the string and drops the empty elements.
+func splitList(str, sep string) []string {
+	var list []string
+	for _, s := range strings.Split(str, sep) {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
 }
 
 func (a *Album) String() string {
@@ -22,10 +84,246 @@ func (a *Album) String() string {
 	return str
 }
 
+// AlbumTag is a tag stuck on an album. Albums can have no tags, or several,
+// such as one per disc of a box set. Tags removed from the album, or moved to
+// another one, are kept with the time they were removed, as the tag history of
+// the album.
+type AlbumTag struct {
+	gorm.Model
+	ID        uint64
+	AlbumID   uint64 `gorm:"index"`
+	Tag       string `gorm:"uniqueIndex:idx_album_tags_tag,where:removed_at IS NULL"`
+	RemovedAt *time.Time
+}
+
 type Log struct {
 	gorm.Model
-	ID      uint64
-	Time    time.Time
-	AlbumID uint64
-	Album   Album
+	ID       uint64
+	Time     time.Time
+	EndTime  *time.Time
+	LastSeen *time.Time
+	AlbumID  uint64
+	Album    Album
+	DeviceID *uint64
+	Device   *Device
+}
+
+// IsOpen returns whether the log is a play that is still on the shelf.
+func (l *Log) IsOpen() bool {
+	return l.LastSeen != nil && l.EndTime == nil
+}
+
+// Duration returns how long the album was on the shelf, or zero if the play
+// is still open or the log was created without tracking the removal.
+func (l *Log) Duration() time.Duration {
+	if l.EndTime == nil {
+		return 0
+	}
+	return l.EndTime.Sub(l.Time)
+}
+
+// LastActivity returns the last time the album was known to be on the shelf.
+func (l *Log) LastActivity() time.Time {
+	if l.EndTime != nil {
+		return *l.EndTime
+	}
+	if l.LastSeen != nil {
+		return *l.LastSeen
+	}
+	return l.Time
+}
+
+// FormatDuration returns a human readable duration of the play, or an empty
+// string if it is unknown.
+func (l *Log) FormatDuration() string {
+	if l.IsOpen() {
+		return "playing"
+	}
+	return formatDuration(l.Duration())
+}
+
+// SuppressedScan is a scan that was not logged because it repeated the previous
+// play within the deduplication window.
+type SuppressedScan struct {
+	gorm.Model
+	ID    uint64
+	Time  time.Time
+	Tag   string
+	LogID uint64
+	Log   Log
+}
+
+// UnknownScan is a scan of a tag that no album had. It waits in the inbox
+// until it is assigned to an album, which logs the play at the time of the
+// scan, or it is dismissed. Scans of the tag repeated on the same device within
+// the deduplication window are counted in Scans, and UpdatedAt is the time of
+// the latest one.
+type UnknownScan struct {
+	gorm.Model
+	ID       uint64
+	Time     time.Time
+	Tag      string `gorm:"index"`
+	DeviceID *uint64
+	Device   *Device
+	Scans    int `gorm:"default:1"`
+}
+
+// Scrobble is a track of a play waiting to be submitted to a scrobbling
+// service, kept until it is submitted. Without the tracklist of the album, the
+// whole album is scrobbled as a track named after it.
+type Scrobble struct {
+	gorm.Model
+	ID          uint64
+	Service     string `gorm:"index"`
+	LogID       uint64
+	Time        time.Time
+	Artist      string
+	Album       string
+	Track       string
+	TrackNumber int
+	MBID        string
+
+	// SendAt is when the scrobble is due, or retried after failing.
+	SendAt   time.Time `gorm:"index"`
+	Attempts int
+	Error    string
+}
+
+const (
+	scopeScan  = "scan"
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+var allScopes = []string{scopeScan, scopeRead, scopeWrite}
+
+// ApiToken is a named credential for the API. Only the SHA-256 hash of the
+// token is stored, as well as a short prefix to tell tokens apart.
+type ApiToken struct {
+	gorm.Model
+	ID         uint64
+	Name       string
+	Prefix     string
+	Hash       string `gorm:"unique"`
+	Scopes     string
+	LastUsedAt *time.Time
+}
+
+func (t *ApiToken) ScopeList() []string {
+	return strings.Split(t.Scopes, ",")
+}
+
+func (t *ApiToken) HasScope(scope string) bool {
+	return slices.Contains(t.ScopeList(), scope)
+}
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+// allRoles are the roles of the users, each one allowed to do everything the
+// previous ones can.
+var allRoles = []string{roleViewer, roleEditor, roleAdmin}
+
+// User is an account for the dashboard. Viewers can browse the collection,
+// editors can also change it, and admins can also manage the users, devices
+// and API tokens.
+type User struct {
+	gorm.Model
+	ID           uint64
+	Username     string `gorm:"unique"`
+	PasswordHash string
+	Role         string
+}
+
+// HasRole returns whether the user has the role, or one above it.
+func (u *User) HasRole(role string) bool {
+	return u != nil && slices.Index(allRoles, u.Role) >= slices.Index(allRoles, role) && slices.Contains(allRoles, role)
+}
+
+func (u *User) CanEdit() bool {
+	return u.HasRole(roleEditor)
+}
+
+func (u *User) IsAdmin() bool {
+	return u.HasRole(roleAdmin)
+}
+
+// Session is a login of a user in a browser. Only the hash of the token in
+// its cookie is stored. The admin from the configuration has the user ID 0.
+type Session struct {
+	gorm.Model
+	ID         uint64
+	TokenHash  string `gorm:"unique"`
+	UserID     uint64 `gorm:"index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Device is a shelf that scans tags, identified by its own API token.
+type Device struct {
+	gorm.Model
+	ID         uint64
+	Name       string
+	Location   string
+	ApiTokenID uint64
+	ApiToken   ApiToken
+	LastSeenAt *time.Time
+
+	// Last heartbeat sent by the device.
+	HeartbeatAt     *time.Time
+	FirmwareVersion string
+	Uptime          time.Duration
+	RSSI            int
+	NFCStatus       string
+
+	// Offline is set once the device was notified as offline, until it is
+	// seen again.
+	Offline bool
+}
+
+func (d *Device) String() string {
+	if d.Location == "" {
+		return d.Name
+	}
+	return d.Name + " (" + d.Location + ")"
+}
+
+// Status returns whether the device is online or offline, or unknown if it
+// was never seen.
+func (d *Device) Status() string {
+	switch {
+	case d.LastSeenAt == nil:
+		return "unknown"
+	case d.Offline:
+		return "offline"
+	default:
+		return "online"
+	}
+}
+
+// FormatUptime returns the uptime of the device at its last heartbeat.
+func (d *Device) FormatUptime() string {
+	if d.HeartbeatAt == nil {
+		return ""
+	}
+	return formatDuration(d.Uptime)
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d <= 0:
+		return ""
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm %02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
 }